@@ -1,10 +1,22 @@
 module github.com/dav-m85/hsnap
 
-go 1.15
+go 1.23.0
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
 	github.com/google/go-cmp v0.5.9
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.18.0
 	github.com/matryer/is v1.4.0
+	github.com/pkg/sftp v1.13.6
 	github.com/schollz/progressbar/v3 v3.7.3
+	golang.org/x/crypto v0.35.0
+	golang.org/x/term v0.29.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of a snapshot file. The whole stream is compressed but its
+// footer, readers detect it from magic bytes so that any snapshot can be read
+// transparently. The footer follows the compressed stream as is, for
+// ReadFooter to seek it: within a skippable frame for zstd, so that zstd
+// tools still read snapshots, and as trailing bytes for gzip.
+type Compression string
+
+const (
+	CompressNone Compression = "none"
+	CompressGzip Compression = "gzip"
+	CompressZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// zstdSkippableMagic starts a zstd frame decoders skip, little endian and
+// followed by its length
+const zstdSkippableMagic = 0x184d2a50
+
+// ParseCompression from a command line value
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case CompressNone, CompressGzip, CompressZstd:
+		return c, nil
+	case "":
+		return CompressNone, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, use none, gzip or zstd", s)
+}
+
+// detect the compression from the first bytes of a snapshot. Uncompressed
+// snapshots start with the gob type definition of Info, which is way longer
+// than what those magic bytes would read as a message length.
+func detect(head []byte) Compression {
+	switch {
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressZstd
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressGzip
+	}
+	return CompressNone
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Compress wraps w, closing the returned writer flushes the compressed stream
+// but does not close w.
+func Compress(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	case CompressNone, "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// CompressSnapshot wraps w like Compress, for a whole snapshot stream: its
+// footer is held back, and written uncompressed after the compressed stream
+// on Close.
+func CompressSnapshot(w io.Writer, c Compression) (io.WriteCloser, error) {
+	zw, err := Compress(w, c)
+	if err != nil || c == CompressNone || c == "" {
+		return zw, err
+	}
+	return &trailerWriter{w: w, zw: zw, c: c}, nil
+}
+
+// trailerWriter compresses all but the last bytes written to it, which hold
+// the footer
+type trailerWriter struct {
+	w    io.Writer
+	zw   io.WriteCloser
+	c    Compression
+	held []byte
+}
+
+// heldSize is what trailerWriter holds back at least
+const heldSize = maxFooterSize + footerTrailerSize
+
+func (t *trailerWriter) Write(p []byte) (int, error) {
+	t.held = append(t.held, p...)
+	if n := len(t.held) - heldSize; n > heldSize {
+		if _, err := t.zw.Write(t.held[:n]); err != nil {
+			return 0, err
+		}
+		t.held = append(t.held[:0], t.held[n:]...)
+	}
+	return len(p), nil
+}
+
+func (t *trailerWriter) Close() error {
+	b := t.held
+	// Streams without a footer, or too large a footer, are compressed whole
+	size := footerSize(b)
+	if _, err := t.zw.Write(b[:len(b)-size]); err != nil {
+		return err
+	}
+	if err := t.zw.Close(); err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	if t.c == CompressZstd {
+		var head [8]byte
+		binary.LittleEndian.PutUint32(head[:4], zstdSkippableMagic)
+		binary.LittleEndian.PutUint32(head[4:], uint32(size))
+		if _, err := t.w.Write(head[:]); err != nil {
+			return err
+		}
+	}
+	_, err := t.w.Write(b[len(b)-size:])
+	return err
+}
+
+// zstdReadCloser appends the footer kept in a trailing skippable frame to the
+// decompressed stream, the decoder skipping it. The decoder is not embedded,
+// its WriteTo would bypass Read.
+type zstdReadCloser struct {
+	d       *zstd.Decoder
+	raw     io.Reader // compressed stream, copied to tail as it is read
+	tail    *tailBuffer
+	trailer io.Reader
+}
+
+func (z *zstdReadCloser) Read(p []byte) (int, error) {
+	if z.trailer != nil {
+		return z.trailer.Read(p)
+	}
+	n, err := z.d.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	if _, err := io.Copy(io.Discard, z.raw); err != nil {
+		return n, err
+	}
+	z.trailer = bytes.NewReader(skippableFrame(z.tail.buf))
+	if n > 0 {
+		return n, nil
+	}
+	return z.trailer.Read(p)
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.d.Close()
+	return nil
+}
+
+// skippableFrame returns the content of the skippable frame ending b, if any
+func skippableFrame(b []byte) []byte {
+	for i := 0; i+8 <= len(b); i++ {
+		if binary.LittleEndian.Uint32(b[i:]) == zstdSkippableMagic &&
+			uint64(binary.LittleEndian.Uint32(b[i+4:])) == uint64(len(b)-i-8) {
+			return b[i+8:]
+		}
+	}
+	return nil
+}
+
+// Decompress r according to its magic bytes, decrypting it first with ids
+// when encrypted, see Decrypt. Closing the returned reader releases
+// decompression resources, not r.
+func Decompress(r io.Reader, ids ...Identity) (io.ReadCloser, Compression, error) {
+	dr, _, err := Decrypt(r, ids...)
+	if err != nil {
+		return nil, "", err
+	}
+	br := bufio.NewReader(dr)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	switch c := detect(head); c {
+	case CompressGzip:
+		// Reading a single member from a ByteReader, gzip leaves the footer
+		// past it in br
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, c, err
+		}
+		zr.Multistream(false)
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(zr, br), zr}, c, nil
+	case CompressZstd:
+		tail := &tailBuffer{max: heldSize}
+		raw := io.TeeReader(br, tail)
+		zr, err := zstd.NewReader(raw)
+		if err != nil {
+			return nil, c, err
+		}
+		return &zstdReadCloser{d: zr, raw: raw, tail: tail}, c, nil
+	default:
+		return io.NopCloser(br), c, nil
+	}
+}
+
+// tailBuffer keeps the last bytes written to it, at least max of them
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > 2*t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
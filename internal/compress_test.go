@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestCompressedSnapshot(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/d2", 0777))
+	is.NoErr(rootFS.WriteFile("d1/d2/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/f2.txt", []byte("def"), 0755))
+
+	FS = rootFS
+
+	for _, c := range []Compression{CompressNone, CompressGzip, CompressZstd} {
+		var buf bytes.Buffer
+		Snapshot("d1", &buf, io.Discard, SnapshotOptions{Compression: c})
+		is.Equal(detect(buf.Bytes()), c)
+
+		tr, err := ReadTree(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		is.Equal(tr.Search("d2/f1.txt").Size, int64(3))
+		is.True(tr.Footer != nil)
+
+		ft, err := ReadFooter(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		is.Equal(ft.Files, int64(2))
+
+		// The footer is reached with a seek
+		ft, err = readPlainFooter(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		is.Equal(ft.Files, int64(2))
+
+		// Older snapshots keep their footer compressed
+		var old bytes.Buffer
+		dr, _, err := Decompress(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		zw, err := Compress(&old, c)
+		is.NoErr(err)
+		_, err = io.Copy(zw, dr)
+		is.NoErr(err)
+		is.NoErr(zw.Close())
+		ft, err = ReadFooter(bytes.NewReader(old.Bytes()))
+		is.NoErr(err)
+		is.Equal(ft.Files, int64(2))
+		tr, err = ReadTree(bytes.NewReader(old.Bytes()))
+		is.NoErr(err)
+		is.Equal(tr.Integrity, Complete)
+	}
+
+	_, err := ParseCompression("lzma")
+	is.True(err != nil)
+}
+
+func TestCompressSnapshot(t *testing.T) {
+	is := is.New(t)
+
+	// Larger than what is held back for the footer
+	var stream bytes.Buffer
+	for i := 0; stream.Len() < 3*heldSize; i++ {
+		fmt.Fprintf(&stream, "node %d\n", i)
+	}
+	is.NoErr(writeFooter(&stream, &Footer{Files: 42}))
+
+	for _, c := range []Compression{CompressGzip, CompressZstd} {
+		var buf bytes.Buffer
+		zw, err := CompressSnapshot(&buf, c)
+		is.NoErr(err)
+		_, err = io.Copy(zw, bytes.NewReader(stream.Bytes()))
+		is.NoErr(err)
+		is.NoErr(zw.Close())
+		is.True(buf.Len() < stream.Len())
+
+		ft, err := readPlainFooter(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		is.Equal(ft.Files, int64(42))
+
+		dr, _, err := Decompress(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		b, err := io.ReadAll(dr)
+		is.NoErr(err)
+		is.True(bytes.Equal(b, stream.Bytes()))
+	}
+}
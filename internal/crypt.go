@@ -0,0 +1,482 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted snapshots start with cryptMagic, followed by the length of a gob
+// encoded cryptHeader and the header itself. A random file key is wrapped
+// once per recipient in the header. The payload (a compressed or plain
+// snapshot) is encrypted in chunks of chunkSize with ChaCha20-Poly1305, under
+// a key derived from the file key and a random nonce of the header. Each
+// chunk nonce is its counter and a last chunk flag, so that reordering,
+// truncating or extending the stream fails authentication.
+const cryptMagic = "hsnapENC"
+
+const chunkSize = 64 * 1024
+
+const (
+	recipientPrefix = "hsnap1"
+	identityPrefix  = "HSNAP-SECRET-KEY-"
+)
+
+// ScryptLogN is the scrypt cost used when encrypting with a Passphrase
+var ScryptLogN = 18
+
+// maxScryptLogN bounds the cost a snapshot can ask for when decrypting
+const maxScryptLogN = 22
+
+// ErrEncrypted is returned when no identity opens an encrypted snapshot
+var ErrEncrypted = errors.New("snapshot is encrypted and no key opens it")
+
+type cryptHeader struct {
+	Stanzas []stanza
+	Nonce   []byte // payload key derivation salt, fresh for each stream
+}
+
+// stanza holds the file key wrapped for one recipient
+type stanza struct {
+	Type      string // scrypt or x25519
+	Salt      []byte
+	LogN      int
+	Ephemeral []byte
+	Body      []byte
+}
+
+// Recipient can have snapshots encrypted for it
+type Recipient interface {
+	wrap(fileKey []byte) (stanza, error)
+}
+
+// Identity can decrypt snapshots
+type Identity interface {
+	// unwrap returns a nil key when the stanza is not for this identity
+	unwrap(s stanza) ([]byte, error)
+}
+
+// Passphrase is both an Identity and a Recipient, the key is derived with
+// scrypt.
+type Passphrase string
+
+func (p Passphrase) wrap(fileKey []byte) (stanza, error) {
+	s := stanza{Type: "scrypt", Salt: make([]byte, 16), LogN: ScryptLogN}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return s, err
+	}
+	kek, err := scrypt.Key([]byte(p), s.Salt, 1<<s.LogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return s, err
+	}
+	s.Body, err = seal(kek, fileKey)
+	return s, err
+}
+
+func (p Passphrase) unwrap(s stanza) ([]byte, error) {
+	if s.Type != "scrypt" {
+		return nil, nil
+	}
+	if s.LogN < 1 || s.LogN > maxScryptLogN {
+		return nil, fmt.Errorf("scrypt cost %d out of bounds", s.LogN)
+	}
+	kek, err := scrypt.Key([]byte(p), s.Salt, 1<<s.LogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return open(kek, s.Body), nil
+}
+
+// X25519Recipient is a public key, written as hsnap1...
+type X25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// X25519Identity is a private key, written as HSNAP-SECRET-KEY-...
+type X25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+func GenerateX25519Identity() (*X25519Identity, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{k}, nil
+}
+
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	raw, err := decodeKey(s, recipientPrefix)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Recipient{k}, nil
+}
+
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	raw, err := decodeKey(s, identityPrefix)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{k}, nil
+}
+
+func decodeKey(s, prefix string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("malformed key, expected %s prefix", prefix)
+	}
+	return base64.RawURLEncoding.DecodeString(s[len(prefix):])
+}
+
+func (r *X25519Recipient) String() string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(r.key.Bytes())
+}
+
+func (i *X25519Identity) String() string {
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(i.key.Bytes())
+}
+
+func (i *X25519Identity) X25519Recipient() *X25519Recipient {
+	return &X25519Recipient{i.key.PublicKey()}
+}
+
+// x25519KEK derives the key wrapping the file key from the shared secret
+func x25519KEK(shared, ephemeral, recipient []byte) ([]byte, error) {
+	kek := make([]byte, chacha20poly1305.KeySize)
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("hsnap x25519")), kek)
+	return kek, err
+}
+
+func (r *X25519Recipient) wrap(fileKey []byte) (stanza, error) {
+	s := stanza{Type: "x25519"}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return s, err
+	}
+	shared, err := eph.ECDH(r.key)
+	if err != nil {
+		return s, err
+	}
+	s.Ephemeral = eph.PublicKey().Bytes()
+	kek, err := x25519KEK(shared, s.Ephemeral, r.key.Bytes())
+	if err != nil {
+		return s, err
+	}
+	s.Body, err = seal(kek, fileKey)
+	return s, err
+}
+
+func (i *X25519Identity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != "x25519" {
+		return nil, nil
+	}
+	eph, err := ecdh.X25519().NewPublicKey(s.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := i.key.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := x25519KEK(shared, s.Ephemeral, i.key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return open(kek, s.Body), nil
+}
+
+// ReadIdentityFile reads the first key of a file written by keygen, skipping
+// # comments.
+func ReadIdentityFile(path string) (*X25519Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return ParseX25519Identity(line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no key found in %s", path)
+}
+
+// seal and open a file key, the wrapping key being single use
+func seal(kek, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+func open(kek, body []byte) []byte {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil
+	}
+	key, err := aead.Open(nil, make([]byte, aead.NonceSize()), body, nil)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// IsEncrypted tells from its first bytes whether a snapshot is encrypted
+func IsEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(cryptMagic))
+}
+
+// Envelope is the file key of an encrypted snapshot along with its wrapped
+// copies, it allows encrypting another stream for the same recipients.
+type Envelope struct {
+	fileKey []byte
+	stanzas []stanza
+}
+
+// Seal a new file key for the given recipients
+func Seal(rs ...Recipient) (*Envelope, error) {
+	if len(rs) == 0 {
+		return nil, errors.New("no recipient to encrypt for")
+	}
+	e := &Envelope{fileKey: make([]byte, chacha20poly1305.KeySize)}
+	if _, err := rand.Read(e.fileKey); err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		s, err := r.wrap(e.fileKey)
+		if err != nil {
+			return nil, err
+		}
+		e.stanzas = append(e.stanzas, s)
+	}
+	return e, nil
+}
+
+// payload prepares the cipher of a stream with the given header
+func (e *Envelope) payload(hb []byte, h cryptHeader) (cipher.AEAD, []byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, e.fileKey, h.Nonce, []byte("hsnap payload")), key); err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad := sha256.Sum256(hb)
+	return aead, ad[:], nil
+}
+
+// Encrypt w for the envelope recipients. Closing the returned writer writes
+// the last chunk but does not close w.
+func (e *Envelope) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	h := cryptHeader{Stanzas: e.stanzas, Nonce: make([]byte, 16)}
+	if _, err := rand.Read(h.Nonce); err != nil {
+		return nil, err
+	}
+
+	var hb bytes.Buffer
+	if err := gob.NewEncoder(&hb).Encode(h); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(cryptMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(hb.Len()))
+	buf.Write(hb.Bytes())
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	aead, ad, err := e.payload(hb.Bytes(), h)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptWriter{w: w, aead: aead, ad: ad}, nil
+}
+
+// Encrypt w for the given recipients, see Envelope.Encrypt
+func Encrypt(w io.Writer, rs ...Recipient) (io.WriteCloser, error) {
+	e, err := Seal(rs...)
+	if err != nil {
+		return nil, err
+	}
+	return e.Encrypt(w)
+}
+
+// chunkNonce is the big endian counter followed by the last chunk flag
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type cryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	buf     []byte
+	counter uint64
+}
+
+func (c *cryptWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	// Keep at least one byte, the last chunk is only known on Close
+	for len(c.buf) > chunkSize {
+		if err := c.flush(c.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[chunkSize:]
+	}
+	return len(p), nil
+}
+
+func (c *cryptWriter) flush(chunk []byte, last bool) error {
+	_, err := c.w.Write(c.aead.Seal(nil, chunkNonce(c.counter, last), chunk, c.ad))
+	c.counter++
+	return err
+}
+
+func (c *cryptWriter) Close() error {
+	err := c.flush(c.buf, true)
+	c.buf = nil
+	return err
+}
+
+// Decrypt r when it is encrypted, trying each identity. The Envelope of the
+// stream is returned, nil for plain snapshots which are read as is.
+func Decrypt(r io.Reader, ids ...Identity) (io.Reader, *Envelope, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(cryptMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !IsEncrypted(head) {
+		return br, nil, nil
+	}
+	br.Discard(len(cryptMagic))
+
+	var size uint32
+	if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+		return nil, nil, err
+	}
+	if size > 1<<20 {
+		return nil, nil, fmt.Errorf("encryption header too large")
+	}
+	hb := make([]byte, size)
+	if _, err := io.ReadFull(br, hb); err != nil {
+		return nil, nil, err
+	}
+	var h cryptHeader
+	if err := gob.NewDecoder(bytes.NewReader(hb)).Decode(&h); err != nil {
+		return nil, nil, err
+	}
+
+	// A stanza that cannot be unwrapped, like one asking for an excessive
+	// scrypt cost, is passed over for the next ones
+	var skipped error
+	for _, id := range ids {
+		for _, s := range h.Stanzas {
+			fileKey, err := id.unwrap(s)
+			if err != nil {
+				skipped = err
+				continue
+			}
+			if fileKey == nil {
+				continue
+			}
+			e := &Envelope{fileKey: fileKey, stanzas: h.Stanzas}
+			aead, ad, err := e.payload(hb, h)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &cryptReader{r: br, aead: aead, ad: ad}, e, nil
+		}
+	}
+	if skipped != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrEncrypted, skipped)
+	}
+	return nil, nil, ErrEncrypted
+}
+
+type cryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func (c *cryptReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next decrypts the following chunk, which is the last one when the stream
+// ends right after it.
+func (c *cryptReader) next() error {
+	chunk := make([]byte, chunkSize+c.aead.Overhead())
+	n, err := io.ReadFull(c.r, chunk)
+	last := false
+	switch err {
+	case nil:
+		_, perr := c.r.Peek(1)
+		last = perr == io.EOF
+	case io.ErrUnexpectedEOF, io.EOF:
+		last = true
+	default:
+		return err
+	}
+	plain, err := c.aead.Open(nil, chunkNonce(c.counter, last), chunk[:n], c.ad)
+	if err != nil {
+		return fmt.Errorf("%w: encrypted chunk %d fails authentication, truncated or tampered", ErrCorrupt, c.counter)
+	}
+	c.counter++
+	c.buf = plain
+	c.done = last
+	return nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func encrypt(is *is.I, data []byte, rs ...Recipient) []byte {
+	var buf bytes.Buffer
+	w, err := Encrypt(&buf, rs...)
+	is.NoErr(err)
+	_, err = w.Write(data)
+	is.NoErr(err)
+	is.NoErr(w.Close())
+	return buf.Bytes()
+}
+
+func decrypt(data []byte, ids ...Identity) ([]byte, error) {
+	r, _, err := Decrypt(bytes.NewReader(data), ids...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryption(t *testing.T) {
+	is := is.New(t)
+	ScryptLogN = 10
+
+	id, err := GenerateX25519Identity()
+	is.NoErr(err)
+	rid, err := ParseX25519Recipient(id.X25519Recipient().String())
+	is.NoErr(err)
+	other, err := GenerateX25519Identity()
+	is.NoErr(err)
+
+	// Several chunks, the last one being partial
+	data := make([]byte, 3*chunkSize+123)
+	rand.Read(data)
+
+	enc := encrypt(is, data, rid, Passphrase("secret"))
+	is.True(IsEncrypted(enc))
+
+	plain, err := decrypt(enc, id)
+	is.NoErr(err)
+	is.Equal(plain, data)
+	plain, err = decrypt(enc, Passphrase("secret"))
+	is.NoErr(err)
+	is.Equal(plain, data)
+
+	_, err = decrypt(enc, other, Passphrase("wrong"))
+	is.Equal(err, ErrEncrypted)
+
+	// Truncated at a chunk boundary, tampered
+	_, err = decrypt(enc[:len(enc)-123-16], id)
+	is.True(err != nil)
+	tampered := append([]byte{}, enc...)
+	tampered[len(tampered)/2] ^= 1
+	_, err = decrypt(tampered, id)
+	is.True(err != nil)
+
+	// Exact chunk multiple, and empty payload
+	for _, size := range []int{chunkSize, 0} {
+		plain, err = decrypt(encrypt(is, data[:size], rid), id)
+		is.NoErr(err)
+		is.Equal(len(plain), size)
+	}
+
+	// Envelope reuse keeps all recipients
+	_, env, err := Decrypt(bytes.NewReader(enc), id)
+	is.NoErr(err)
+	var buf bytes.Buffer
+	w, err := env.Encrypt(&buf)
+	is.NoErr(err)
+	w.Write(data[:10])
+	is.NoErr(w.Close())
+	plain, err = decrypt(buf.Bytes(), Passphrase("secret"))
+	is.NoErr(err)
+	is.Equal(plain, data[:10])
+
+	// A stanza asking for an excessive cost is passed over
+	enc = encrypt(is, data[:10], costly{}, Passphrase("secret"))
+	plain, err = decrypt(enc, Passphrase("secret"))
+	is.NoErr(err)
+	is.Equal(plain, data[:10])
+	_, err = decrypt(enc, Passphrase("wrong"))
+	is.True(errors.Is(err, ErrEncrypted))
+
+	// Plain data goes through
+	plain, err = decrypt(data[:10])
+	is.NoErr(err)
+	is.Equal(plain, data[:10])
+}
+
+// costly wraps nothing, asking for an out of bounds scrypt cost
+type costly struct{}
+
+func (costly) wrap(fileKey []byte) (stanza, error) {
+	return stanza{Type: "scrypt", Salt: make([]byte, 16), LogN: 40, Body: fileKey}, nil
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeKind of a path between two snapshots
+type ChangeKind string
+
+const (
+	Added     ChangeKind = "added"
+	Removed   ChangeKind = "removed"
+	Modified  ChangeKind = "modified"
+	Moved     ChangeKind = "moved"
+	Unchanged ChangeKind = "unchanged"
+)
+
+// ChangeKinds in reporting order
+var ChangeKinds = []ChangeKind{Added, Removed, Modified, Moved, Unchanged}
+
+// Change of a single path. Size is the size in the newer snapshot, or in the
+// older one for removed paths.
+type Change struct {
+	Kind    ChangeKind `json:"kind"`
+	Path    string     `json:"path"`
+	OldPath string     `json:"old_path,omitempty"` // moved only
+	Size    int64      `json:"size"`
+	OldSize int64      `json:"old_size,omitempty"` // modified only
+	Reason  string     `json:"reason,omitempty"`   // modified only
+	Dir     bool       `json:"dir,omitempty"`
+}
+
+// DiffTotal counts changes of a kind, and their bytes
+type DiffTotal struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Diff between two snapshots, changes being sorted by path
+type Diff struct {
+	Changes []Change                 `json:"changes"`
+	Totals  map[ChangeKind]DiffTotal `json:"totals"`
+}
+
+// DiffTrees matches nodes of a and b by path, then files found on one side
+// only by hash: a file removed from a and added to b with the same content
+// has moved. Directories never move, nor do empty files as they all share
+// the same hash.
+func DiffTrees(a, b *Tree) *Diff {
+	return diffTrees(a, b, contentChange)
+}
+
+// contentChange tells why nodes at the same path differ, if they do
+func contentChange(o, n *Node) string {
+	switch {
+	case o.Mode.IsDir() != n.Mode.IsDir():
+		return "type"
+	case o.Mode.IsDir():
+		return "" // changes show up in their content
+	case o.Failed() != n.Failed():
+		return "unreadable"
+	case size(o) != size(n):
+		return "size"
+	case o.Hash != n.Hash:
+		return "content"
+	}
+	return ""
+}
+
+func diffTrees(a, b *Tree, changed func(o, n *Node) string) *Diff {
+	d := &Diff{Totals: make(map[ChangeKind]DiffTotal)}
+
+	olds := make(map[string]*Node)
+	a.Walk(func(path string, n *Node) error {
+		if path != "" {
+			olds[path] = n
+		}
+		return nil
+	})
+
+	var added []Change
+	adds := make(map[string]*Node)
+	b.Walk(func(path string, n *Node) error {
+		if path == "" {
+			return nil
+		}
+		o, ok := olds[path]
+		if !ok {
+			added = append(added, Change{Kind: Added, Path: path, Size: size(n), Dir: n.Mode.IsDir()})
+			adds[path] = n
+			return nil
+		}
+		delete(olds, path)
+		c := Change{Kind: Unchanged, Path: path, Size: size(n), Dir: n.Mode.IsDir()}
+		if c.Reason = changed(o, n); c.Reason != "" {
+			c.Kind, c.OldSize = Modified, size(o)
+		}
+		d.add(c)
+		return nil
+	})
+
+	// Whatever is left of a has been removed, or moved
+	gone := make(HashGroup)
+	var removed []Change
+	for path, o := range olds {
+		if o.Size > 0 {
+			gone.Add(o)
+		}
+		removed = append(removed, Change{Kind: Removed, Path: path, Size: size(o), Dir: o.Mode.IsDir()})
+	}
+	for _, g := range gone {
+		sort.Slice(g, func(i, j int) bool { return a.RelPath(g[i]) < a.RelPath(g[j]) })
+	}
+
+	moved := make(map[string]bool)
+	sortChanges(added)
+	for _, c := range added {
+		n := adds[c.Path]
+		if g := gone[n.Hash]; !c.Dir && n.Size > 0 && !n.Failed() && len(g) > 0 {
+			from := a.RelPath(g[0])
+			gone[n.Hash] = g[1:]
+			moved[from] = true
+			c.Kind, c.OldPath = Moved, from
+		}
+		d.add(c)
+	}
+	for _, c := range removed {
+		if !moved[c.Path] {
+			d.add(c)
+		}
+	}
+
+	sortChanges(d.Changes)
+	return d
+}
+
+func (d *Diff) add(c Change) {
+	d.Changes = append(d.Changes, c)
+	t := d.Totals[c.Kind]
+	t.Count++
+	t.Bytes += c.Size
+	d.Totals[c.Kind] = t
+}
+
+// size of a node content, directories having none
+func size(n *Node) int64 {
+	if n.Mode.IsDir() {
+		return 0
+	}
+	return n.Size
+}
+
+func sortChanges(cs []Change) {
+	sort.Slice(cs, func(i, j int) bool {
+		return pathKey(cs[i].Path) < pathKey(cs[j].Path)
+	})
+}
+
+// DirChanges rolls up the changes below a directory
+type DirChanges struct {
+	Dir    string                   `json:"dir"`
+	Totals map[ChangeKind]DiffTotal `json:"totals"`
+}
+
+// Rollup aggregates changes per directory, cut at depth levels below the
+// root. Files sitting higher than depth are accounted in their own directory.
+// Unchanged paths are left out, as are directories without any change.
+func (d *Diff) Rollup(depth int) []DirChanges {
+	byDir := make(map[string]*DirChanges)
+	var dirs []string
+	for _, c := range d.Changes {
+		if c.Kind == Unchanged {
+			continue
+		}
+		dir := rollupDir(c.Path, depth)
+		dc, ok := byDir[dir]
+		if !ok {
+			dc = &DirChanges{Dir: dir, Totals: make(map[ChangeKind]DiffTotal)}
+			byDir[dir] = dc
+			dirs = append(dirs, dir)
+		}
+		t := dc.Totals[c.Kind]
+		t.Count++
+		t.Bytes += c.Size
+		dc.Totals[c.Kind] = t
+	}
+	sort.Slice(dirs, func(i, j int) bool { return pathKey(dirs[i]) < pathKey(dirs[j]) })
+	dcs := make([]DirChanges, len(dirs))
+	for i, dir := range dirs {
+		dcs[i] = *byDir[dir]
+	}
+	return dcs
+}
+
+func rollupDir(path string, depth int) string {
+	dir := filepath.Dir(path)
+	if dir == "." {
+		return ""
+	}
+	parts := strings.Split(dir, string(filepath.Separator))
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return filepath.Join(parts...)
+}
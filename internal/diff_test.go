@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestDiffTrees(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("v1/docs", 0777))
+	is.NoErr(rootFS.MkdirAll("v1/old", 0777))
+	is.NoErr(rootFS.WriteFile("v1/docs/same.txt", []byte("same"), 0755))
+	is.NoErr(rootFS.WriteFile("v1/docs/edit.txt", []byte("before"), 0755))
+	is.NoErr(rootFS.WriteFile("v1/old/photo.jpg", []byte("photo"), 0755))
+	is.NoErr(rootFS.WriteFile("v1/gone.txt", []byte("gone"), 0755))
+
+	is.NoErr(rootFS.MkdirAll("v2/docs", 0777))
+	is.NoErr(rootFS.MkdirAll("v2/new", 0777))
+	is.NoErr(rootFS.WriteFile("v2/docs/same.txt", []byte("same"), 0755))
+	is.NoErr(rootFS.WriteFile("v2/docs/edit.txt", []byte("after!!"), 0755))
+	is.NoErr(rootFS.WriteFile("v2/new/photo.jpg", []byte("photo"), 0755))
+	is.NoErr(rootFS.WriteFile("v2/new/fresh.txt", []byte("fresh"), 0755))
+
+	FS = rootFS
+
+	d := DiffTrees(readTree(is, "v1"), readTree(is, "v2"))
+
+	is.Equal(d.Changes, []Change{
+		{Kind: Unchanged, Path: "docs", Dir: true},
+		{Kind: Modified, Path: "docs/edit.txt", Size: 7, OldSize: 6, Reason: "size"},
+		{Kind: Unchanged, Path: "docs/same.txt", Size: 4},
+		{Kind: Removed, Path: "gone.txt", Size: 4},
+		{Kind: Added, Path: "new", Dir: true},
+		{Kind: Added, Path: "new/fresh.txt", Size: 5},
+		{Kind: Moved, Path: "new/photo.jpg", OldPath: "old/photo.jpg", Size: 5},
+		{Kind: Removed, Path: "old", Dir: true},
+	})
+	is.Equal(d.Totals[Added], DiffTotal{2, 5})
+	is.Equal(d.Totals[Removed], DiffTotal{2, 4})
+	is.Equal(d.Totals[Moved], DiffTotal{1, 5})
+
+	is.Equal(d.Rollup(1), []DirChanges{
+		{"", map[ChangeKind]DiffTotal{Removed: {2, 4}, Added: {1, 0}}},
+		{"docs", map[ChangeKind]DiffTotal{Modified: {1, 7}}},
+		{"new", map[ChangeKind]DiffTotal{Added: {1, 5}, Moved: {1, 5}}},
+	})
+}
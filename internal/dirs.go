@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directories have a Merkle hash: the sha1 of their children names and
+// hashes, sorted by name. Nodes being streamed parents first, directory
+// hashes cannot be stored along with their node. From version 3, snapshots
+// store them in a section of their own after the end of nodes, see
+// dirHasher, which ReadTree applies. It derives them for older snapshots, see
+// HashDirs.
+//
+// A directory holding an unreadable node keeps a zero Hash, as its content
+// is not fully known, it is never reported as a duplicate. So do all
+// directories of truncated or corrupt snapshots.
+
+// DirStats sums up the content of a directory and its subdirectories
+type DirStats struct {
+	Files int64
+	Bytes int64
+}
+
+// HashDirs computes directory hashes and stats, bottom-up from the files.
+// ReadTree calls it, trees built otherwise need to call it once all their
+// nodes are added.
+func (t *Tree) HashDirs() {
+	t.sumDirs(true)
+}
+
+// sumDirs computes directory stats, and their hashes too if hash
+func (t *Tree) sumDirs(hash bool) {
+	if len(t.nodes) == 0 {
+		return
+	}
+	var order Nodes
+	t.Walk(func(_ string, n *Node) error {
+		order = append(order, n)
+		return nil
+	})
+
+	stats := make(map[int]DirStats, len(order))
+	tainted := make(map[int]bool)
+	var buf [sha1.Size]byte
+	// Children come after their parent when walking, reverse it to get them
+	// first
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		if !n.Mode.IsDir() {
+			continue
+		}
+		cs := t.ChildrenOf(n)
+		sort.Slice(cs, func(i, j int) bool { return cs[i].Name < cs[j].Name })
+
+		var st DirStats
+		h := sha1.New()
+		bad := n.Failed()
+		for _, c := range cs {
+			switch {
+			case c.Failed() || tainted[c.ID]:
+				bad = true
+			case c.Mode.IsDir():
+				cst := stats[c.ID]
+				st.Files += cst.Files
+				st.Bytes += cst.Bytes
+			default:
+				st.Files++
+				st.Bytes += c.Size
+			}
+			writeEntry(h, c.Name, c.Hash)
+		}
+		stats[n.ID] = st
+		if !hash {
+			continue
+		}
+		if bad {
+			tainted[n.ID] = true
+			n.Hash = [sha1.Size]byte{}
+		} else {
+			copy(buf[:], h.Sum(nil))
+			n.Hash = buf
+		}
+	}
+
+	t.mu.Lock()
+	t.stats = stats
+	t.mu.Unlock()
+}
+
+// writeEntry adds a directory entry to the hash of its directory
+func writeEntry(h io.Writer, name string, hash [sha1.Size]byte) {
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	h.Write(hash[:])
+}
+
+// dirHash is what snapshots store of a directory hash, directories with a
+// zero hash being left out. The section ends with an endOfNodesID.
+type dirHash struct {
+	ID   int
+	Hash [sha1.Size]byte
+}
+
+// dirHasher computes directory hashes as nodes get written. A directory is
+// hashed once its node and all its entries are in, so that only those with
+// pending content are held. Entries are only counted for directories listed
+// by WalkFS, others wait for finish.
+type dirHasher struct {
+	dirs   map[int]*pendingDir
+	hashes []dirHash
+}
+
+type pendingDir struct {
+	name    string
+	parent  int
+	seen    bool // its node is in
+	want    int  // entries, -1 when unknown
+	bad     bool
+	entries []dirEntry
+}
+
+type dirEntry struct {
+	name string
+	hash [sha1.Size]byte
+}
+
+func newDirHasher() *dirHasher {
+	return &dirHasher{dirs: make(map[int]*pendingDir)}
+}
+
+func (d *dirHasher) pending(id int) *pendingDir {
+	p := d.dirs[id]
+	if p == nil {
+		p = &pendingDir{want: -1}
+		d.dirs[id] = p
+	}
+	return p
+}
+
+// add a node, in any order
+func (d *dirHasher) add(n *Node) {
+	if !n.Mode.IsDir() {
+		d.entry(n.ParentID, dirEntry{n.Name, n.Hash}, n.Failed())
+		return
+	}
+	p := d.pending(n.ID)
+	p.name, p.parent, p.seen = n.Name, n.ParentID, true
+	p.bad = p.bad || n.Failed()
+	if n.listed {
+		p.want = n.entries
+	}
+	d.check(n.ID, p)
+}
+
+func (d *dirHasher) entry(id int, e dirEntry, bad bool) {
+	p := d.pending(id)
+	p.entries = append(p.entries, e)
+	p.bad = p.bad || bad
+	d.check(id, p)
+}
+
+func (d *dirHasher) check(id int, p *pendingDir) {
+	if p.seen && len(p.entries) == p.want {
+		d.done(id, p)
+	}
+}
+
+// done hashes a directory, and adds it to its parent
+func (d *dirHasher) done(id int, p *pendingDir) {
+	delete(d.dirs, id)
+	sort.Slice(p.entries, func(i, j int) bool {
+		return p.entries[i].name < p.entries[j].name
+	})
+	var hash [sha1.Size]byte
+	if !p.bad {
+		h := sha1.New()
+		for _, e := range p.entries {
+			writeEntry(h, e.name, e.hash)
+		}
+		copy(hash[:], h.Sum(nil))
+		d.hashes = append(d.hashes, dirHash{id, hash})
+	}
+	if p.parent != id { // root is its own parent
+		d.entry(p.parent, dirEntry{p.name, hash}, p.bad)
+	}
+}
+
+// finish hashes the directories left, deepest first, and returns all hashes
+func (d *dirHasher) finish() []dirHash {
+	depths := make(map[int]int, len(d.dirs))
+	var depth func(id int) int
+	depth = func(id int) int {
+		p, ok := d.dirs[id]
+		if !ok || p.parent == id {
+			return 0
+		}
+		if x, ok := depths[id]; ok {
+			return x
+		}
+		depths[id] = depth(p.parent) + 1
+		return depths[id]
+	}
+	var ids []int
+	for id, p := range d.dirs {
+		if p.seen {
+			ids = append(ids, id)
+			depth(id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return depths[ids[i]] > depths[ids[j]]
+	})
+	for _, id := range ids {
+		// Completing a child may have completed its parent already
+		if p, ok := d.dirs[id]; ok {
+			d.done(id, p)
+		}
+	}
+	return d.hashes
+}
+
+// DirStats of a directory, as computed by HashDirs. Files only account for
+// themselves.
+func (t *Tree) DirStats(n *Node) DirStats {
+	if !n.Mode.IsDir() {
+		if n.Failed() {
+			return DirStats{}
+		}
+		return DirStats{Files: 1, Bytes: n.Size}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats[n.ID]
+}
+
+// comparableDir tells whether a directory can be matched by its hash: fully
+// read and holding at least a file
+func (t *Tree) comparableDir(n *Node) bool {
+	return n.Mode.IsDir() && n.Hash != [sha1.Size]byte{} && t.DirStats(n).Files > 0
+}
+
+// DirMatch is a directory identical to others, Others being from other trees
+// when trimming.
+type DirMatch struct {
+	Dir    *Node
+	Others Nodes
+}
+
+// TrimDirs finds the directories of t that are identical to a directory of
+// withs, by hash. Only the topmost ones are returned, by path, their
+// subdirectories being identical as well.
+func (t *Tree) TrimDirs(withs ...*Tree) (ms []DirMatch) {
+	others := make(map[[sha1.Size]byte]Nodes)
+	for _, tx := range withs {
+		for _, n := range tx.nodes {
+			if tx.comparableDir(n) {
+				others[n.Hash] = append(others[n.Hash], n)
+			}
+		}
+	}
+	t.Walk(func(_ string, n *Node) error {
+		if !t.comparableDir(n) {
+			return nil
+		}
+		if xs, ok := others[n.Hash]; ok {
+			ms = append(ms, DirMatch{n, xs})
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return
+}
+
+// DupDirs groups identical directories across ts, including within a same
+// tree. Only topmost duplicates are grouped, their subdirectories being
+// duplicates as well. Groups are sorted by decreasing size.
+func DupDirs(ts ...*Tree) (groups []Nodes) {
+	byHash := make(map[[sha1.Size]byte]Nodes)
+	for _, t := range ts {
+		for _, n := range t.nodes {
+			if t.comparableDir(n) {
+				byHash[n.Hash] = append(byHash[n.Hash], n)
+			}
+		}
+	}
+	seen := make(map[[sha1.Size]byte]bool)
+	for _, t := range ts {
+		t.Walk(func(_ string, n *Node) error {
+			if g := byHash[n.Hash]; t.comparableDir(n) && len(g) > 1 {
+				if !seen[n.Hash] {
+					seen[n.Hash] = true
+					groups = append(groups, g)
+				}
+				return fs.SkipDir
+			}
+			return nil
+		})
+	}
+	for _, g := range groups {
+		sort.Slice(g, func(i, j int) bool { return g[i].Path() < g[j].Path() })
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i][0].Tree().DirStats(groups[i][0]).Bytes > groups[j][0].Tree().DirStats(groups[j][0]).Bytes
+	})
+	return
+}
+
+// Below lists the nodes of dirs and their descendants
+func Below(dirs Nodes) map[*Node]bool {
+	in := make(map[*Node]bool)
+	for _, d := range dirs {
+		d.tree.WalkFrom(d, func(_ string, n *Node) error {
+			in[n] = true
+			return nil
+		})
+	}
+	return in
+}
+
+// DirOverlap is a directory whose files are partly found elsewhere
+type DirOverlap struct {
+	Dir       *Node
+	Contained DirStats // files that have a match
+	Total     DirStats
+}
+
+// Ratio of bytes contained elsewhere
+func (o DirOverlap) Ratio() float64 {
+	if o.Total.Bytes == 0 {
+		return 0
+	}
+	return float64(o.Contained.Bytes) / float64(o.Total.Bytes)
+}
+
+// DirOverlaps lists the topmost directories of t having at least min of
+// their bytes in matched, as returned by Trim. Directories in skip and below
+// are left out.
+func (t *Tree) DirOverlaps(matched HashGroup, min float64, skip Nodes) (ovs []DirOverlap) {
+	found := make(map[*Node]bool)
+	for _, n := range matched.Select(t) {
+		found[n] = true
+	}
+
+	// Account each matched file in all its ancestors
+	contained := make(map[int]DirStats)
+	for n := range found {
+		for p := t.nodes[n.ParentID]; p != nil; p = t.nodes[p.ParentID] {
+			c := contained[p.ID]
+			c.Files++
+			c.Bytes += n.Size
+			contained[p.ID] = c
+			if p.ParentID == p.ID {
+				break
+			}
+		}
+	}
+
+	skipped := Below(skip)
+	t.Walk(func(_ string, n *Node) error {
+		if skipped[n] {
+			return fs.SkipDir
+		}
+		if !n.Mode.IsDir() {
+			return nil
+		}
+		o := DirOverlap{n, contained[n.ID], t.DirStats(n)}
+		if o.Total.Files > 0 && o.Ratio() >= min {
+			ovs = append(ovs, o)
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return
+}
+
+// DirUsage is the content of a directory, see Tree.Usage
+type DirUsage struct {
+	Path string
+	DirStats
+}
+
+// Usage lists n and its subdirectories down to depth levels below it, with
+// their recursive stats, largest first. Ties are sorted by path.
+func (t *Tree) Usage(n *Node, depth int) (us []DirUsage) {
+	base := strings.Count(t.RelPath(n), string(filepath.Separator))
+	if n != t.Root() {
+		base++
+	}
+	t.WalkFrom(n, func(path string, x *Node) error {
+		if !x.Mode.IsDir() {
+			return nil
+		}
+		level := 0
+		if x != n {
+			level = strings.Count(path, string(filepath.Separator)) + 1 - base
+		}
+		if level > depth {
+			return fs.SkipDir
+		}
+		us = append(us, DirUsage{path, t.DirStats(x)})
+		return nil
+	})
+	sort.SliceStable(us, func(i, j int) bool {
+		if us[i].Bytes != us[j].Bytes {
+			return us[i].Bytes > us[j].Bytes
+		}
+		return pathKey(us[i].Path) < pathKey(us[j].Path)
+	})
+	return
+}
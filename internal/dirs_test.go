@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"io/fs"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestDirHashes(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	for _, d := range []string{"d1/album", "d1/copy/album", "d2/album", "d2/mixed", "d1/mixed"} {
+		is.NoErr(rootFS.MkdirAll(d, 0777))
+		if d != "d1/mixed" && d != "d2/mixed" {
+			is.NoErr(rootFS.WriteFile(d+"/a.jpg", []byte("aaaa"), 0755))
+			is.NoErr(rootFS.WriteFile(d+"/b.jpg", []byte("bbbb"), 0755))
+		}
+	}
+	is.NoErr(rootFS.WriteFile("d1/mixed/c.jpg", []byte("cccccccc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/mixed/d.jpg", []byte("dd"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/mixed/c.jpg", []byte("cccccccc"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/mixed/e.jpg", []byte("ee"), 0755))
+
+	FS = rootFS
+
+	t1, t2 := readTree(is, "d1"), readTree(is, "d2")
+
+	album := t1.Search("album")
+	is.True(album.Hash != [sha1.Size]byte{})
+
+	// Hashes stored while snapshotting are the ones derived from the files
+	stored := make(map[int][sha1.Size]byte)
+	t1.Walk(func(_ string, n *Node) error {
+		stored[n.ID] = n.Hash
+		return nil
+	})
+	t1.HashDirs()
+	t1.Walk(func(_ string, n *Node) error {
+		is.Equal(n.Hash, stored[n.ID])
+		return nil
+	})
+	is.Equal(album.Hash, t1.Search("copy/album").Hash)
+	is.Equal(album.Hash, t2.Search("album").Hash)
+	is.True(t1.Search("copy").Hash != album.Hash) // names matter
+	is.Equal(t1.DirStats(t1.Root()), DirStats{Files: 6, Bytes: 26})
+
+	// Topmost duplicates only, copy/album is not reported a second time
+	// through copy
+	groups := DupDirs(t1)
+	is.Equal(len(groups), 1)
+	is.Equal(groups[0], Nodes{album, t1.Search("copy/album")})
+	is.Equal(len(DupDirs(t1, t2)), 1)
+	is.Equal(len(DupDirs(t1, t2)[0]), 3)
+
+	ms := t1.TrimDirs(t2)
+	is.Equal(len(ms), 2)
+	is.Equal(ms[0].Dir, album)
+	is.Equal(ms[1].Dir, t1.Search("copy/album"))
+	is.True(Below(Nodes{album})[t1.Search("album/a.jpg")])
+
+	// mixed is 80% elsewhere, the root 92% given albums
+	matches := t1.Trim(t2)
+	matches.PruneSingleTreeGroups()
+	var dirs Nodes
+	for _, m := range ms {
+		dirs = append(dirs, m.Dir)
+	}
+	ovs := t1.DirOverlaps(matches, 0.9, dirs)
+	is.Equal(len(ovs), 1)
+	is.Equal(ovs[0].Dir, t1.Root())
+	is.Equal(ovs[0].Contained, DirStats{Files: 5, Bytes: 24})
+	ovs = t1.DirOverlaps(matches, 0.8, append(dirs, t1.Root()))
+	is.Equal(len(ovs), 0)
+	ovs = t1.DirOverlaps(matches, 0.8, append(dirs, t1.Search("copy")))
+	is.Equal(len(ovs), 1)
+	// copy only holds a duplicate album, it is fully contained elsewhere
+	ovs = t1.DirOverlaps(matches, 0.95, dirs)
+	is.Equal(len(ovs), 1)
+	is.Equal(ovs[0].Dir, t1.Search("copy"))
+
+	// Unreadable content taints directories up to the root
+	tr := NewTree()
+	tr.Info = new(Info)
+	tr.Add(&Node{ID: 0, Name: "root", Mode: fs.ModeDir})
+	tr.Add(&Node{ID: 1, ParentID: 0, Name: "sub", Mode: fs.ModeDir})
+	tr.Add(&Node{ID: 2, ParentID: 1, Name: "f", Size: 1, Err: "denied"})
+	tr.Add(&Node{ID: 3, ParentID: 0, Name: "g", Size: 1})
+	tr.HashDirs()
+	is.Equal(tr.Node(1).Hash, [sha1.Size]byte{})
+	is.Equal(tr.Node(0).Hash, [sha1.Size]byte{})
+	is.Equal(tr.DirStats(tr.Node(0)), DirStats{Files: 1, Bytes: 1})
+}
+
+func TestUsage(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/photos/2020", 0777))
+	is.NoErr(rootFS.MkdirAll("d1/docs", 0777))
+	is.NoErr(rootFS.WriteFile("d1/photos/2020/a.jpg", []byte("aaaaaaaa"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/photos/b.jpg", []byte("bbbb"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/docs/c.txt", []byte("cc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/d.txt", []byte("d"), 0755))
+
+	FS = rootFS
+	tr := readTree(is, "d1")
+
+	is.Equal(tr.Usage(tr.Root(), 1), []DirUsage{
+		{"", DirStats{4, 15}},
+		{"photos", DirStats{2, 12}},
+		{"docs", DirStats{1, 2}},
+	})
+	is.Equal(tr.Usage(tr.Search("photos"), 5), []DirUsage{
+		{"photos", DirStats{2, 12}},
+		{"photos/2020", DirStats{1, 8}},
+	})
+	is.Equal(len(tr.Usage(tr.Root(), 0)), 1)
+
+}
+
+func TestDirHasher(t *testing.T) {
+	is := is.New(t)
+
+	// Listed directories are hashed as soon as their content is in, in any
+	// order
+	d := newDirHasher()
+	d.add(&Node{ID: 2, ParentID: 1, Name: "f", Hash: [sha1.Size]byte{1}})
+	d.add(&Node{ID: 0, Name: "root", Mode: fs.ModeDir, entries: 1, listed: true})
+	d.add(&Node{ID: 1, Name: "sub", Mode: fs.ModeDir, entries: 1, listed: true})
+	is.Equal(len(d.dirs), 0)
+	is.Equal(len(d.hashes), 2)
+
+	// Others wait for finish
+	d = newDirHasher()
+	d.add(&Node{ID: 0, Name: "root", Mode: fs.ModeDir})
+	d.add(&Node{ID: 1, Name: "sub", Mode: fs.ModeDir})
+	d.add(&Node{ID: 2, ParentID: 1, Name: "f", Hash: [sha1.Size]byte{1}})
+	d.add(&Node{ID: 3, ParentID: 1, Name: "g", Err: "denied"})
+	is.Equal(len(d.hashes), 0)
+	is.Equal(d.finish(), []dirHash(nil)) // both tainted by g
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"errors"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// Extract the subtree at path into a standalone snapshot written to out. It
+// is renumbered from 0 and rooted at the directory path points to, on the
+// host of the original snapshot. Its nonce is new, the original one being
+// kept in DerivedFrom.
+func Extract(t *Tree, path string, out io.Writer, opt SnapshotOptions) error {
+	n := t.Search(path)
+	if n == nil {
+		return errors.New("path not found in snapshot")
+	}
+	if !n.Mode.IsDir() {
+		return errors.New("only directories can be extracted")
+	}
+
+	base := *t.Info
+	if t.Info.IsCatalog() {
+		src := t.Source(n)
+		if src == nil {
+			return errors.New("cannot extract the root of a catalog")
+		}
+		base = src.Info
+		base.DerivedFrom = append([]uuid.UUID{t.Info.Nonce}, base.DerivedFrom...)
+	}
+
+	info := Info{
+		Version:     VERSION,
+		RootPath:    t.AbsPath(n),
+		CreatedAt:   base.CreatedAt,
+		Nonce:       uuid.New(),
+		Hostname:    base.Hostname,
+		DerivedFrom: append([]uuid.UUID{base.Nonce}, base.DerivedFrom...),
+	}
+
+	sw, err := newSnapshotWriter(out, info, opt)
+	if err != nil {
+		return err
+	}
+	id := 0
+	if err := writeSubtree(sw, t, n, n.Name, 0, &id); err != nil {
+		return err
+	}
+	return sw.Close()
+}
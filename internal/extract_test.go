@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestExtract(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("nas/volume1/photos/2020", 0777))
+	is.NoErr(rootFS.MkdirAll("nas/volume1/docs", 0777))
+	is.NoErr(rootFS.WriteFile("nas/volume1/photos/2020/a.jpg", []byte("aaa"), 0755))
+	is.NoErr(rootFS.WriteFile("nas/volume1/photos/b.jpg", []byte("bbb"), 0755))
+	is.NoErr(rootFS.WriteFile("nas/volume1/docs/c.txt", []byte("ccc"), 0755))
+
+	FS = rootFS
+
+	extract := func(t *Tree, path string) *Tree {
+		var buf bytes.Buffer
+		is.NoErr(Extract(t, path, &buf, SnapshotOptions{}))
+		x, err := ReadTree(&buf)
+		is.NoErr(err)
+		return x
+	}
+
+	nas := readTree(is, "nas")
+	photos := extract(nas, "volume1/photos")
+
+	is.Equal(photos.Info.RootPath, "nas/volume1/photos")
+	is.Equal(photos.Info.DerivedFrom[0], nas.Info.Nonce)
+	is.True(photos.Info.Nonce != nas.Info.Nonce)
+	is.Equal(photos.Root().ID, 0)
+	is.Equal(photos.Root().Name, "photos")
+	is.Equal(photos.Footer.Files, int64(2))
+	is.Equal(photos.Search("2020/a.jpg").Hash, nas.Search("volume1/photos/2020/a.jpg").Hash)
+	is.True(photos.Search("c.txt") == nil)
+
+	// Derived snapshots cannot be trimmed against their origin
+	is.True(photos.Overlaps(nas))
+	is.True(nas.Overlaps(photos))
+	docs := extract(nas, "volume1/docs")
+	is.True(!docs.Overlaps(photos))
+
+	// Nor against a catalog they come from
+	var buf bytes.Buffer
+	is.NoErr(Merge(&buf, SnapshotOptions{}, docs, photos))
+	c, err := ReadTree(&buf)
+	is.NoErr(err)
+	again := extract(c, photos.Info.Hostname+"-photos/2020")
+	is.Equal(again.Info.RootPath, "nas/volume1/photos/2020")
+	is.True(again.Overlaps(c))
+	is.True(again.Overlaps(nas))
+
+	is.True(Extract(nas, "volume1/nope", &buf, SnapshotOptions{}) != nil)
+	is.True(Extract(nas, "volume1/docs/c.txt", &buf, SnapshotOptions{}) != nil)
+	is.True(Extract(c, "", &buf, SnapshotOptions{}) != nil)
+}
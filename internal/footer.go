@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// endOfNodesID marks the end of the node stream. From version 2, the last
+// Node has this ID and the node stream is followed by a footer. From version
+// 3, directory hashes come in between, ending the same way, see dirHash.
+const endOfNodesID = -1
+
+// footerMagic closes a snapshot file, right after the footer length.
+const footerMagic = "hsnapEND"
+
+// footerTrailerSize is the size of the footer length and footerMagic
+const footerTrailerSize = 8 + len(footerMagic)
+
+var (
+	// ErrNoFooter is returned for snapshots that predate footers
+	ErrNoFooter = errors.New("snapshot has no footer")
+	// ErrTruncated is returned when a snapshot ends before its footer
+	ErrTruncated = errors.New("snapshot is truncated")
+	// ErrCorrupt is returned when a snapshot cannot be decoded
+	ErrCorrupt = errors.New("snapshot is corrupt")
+)
+
+// Integrity of a snapshot, as found by ReadTree
+type Integrity int
+
+const (
+	// Unverified snapshots predate the end marker, or were not read from a
+	// file at all. There is no telling whether they are complete.
+	Unverified Integrity = iota
+	// Complete snapshots have their end marker and footer, and match their
+	// checksum
+	Complete
+	// Truncated snapshots end before their footer
+	Truncated
+	// Corrupt snapshots cannot be decoded, or do not match their checksum
+	Corrupt
+)
+
+func (i Integrity) String() string {
+	switch i {
+	case Complete:
+		return "complete"
+	case Truncated:
+		return "truncated"
+	case Corrupt:
+		return "corrupt"
+	}
+	return "unverified"
+}
+
+// integrityError classifies a decoding error: running out of bytes means
+// the snapshot is truncated, anything else that it is corrupt.
+func integrityError(err error) (Integrity, error) {
+	switch {
+	case errors.Is(err, ErrTruncated):
+		return Truncated, err
+	case errors.Is(err, ErrCorrupt), errors.Is(err, ErrChecksum):
+		return Corrupt, err
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return Truncated, ErrTruncated
+	}
+	return Corrupt, fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+// Footer holds summary statistics of a snapshot, so that they can be read
+// without decoding every node. It is gob encoded on its own after the node
+// stream, and followed by its length and footerMagic:
+//
+//	[gob Info, Node..., end Node, dirHash..., end dirHash][gob Footer][uint64 length][footerMagic]
+type Footer struct {
+	Files, Dirs int64
+	Bytes       int64 // Total size of readable files
+	Errors      int64 // Nodes that could not be read, see Node.Err
+	Skipped     int64 // Entries left out by the Skipper
+
+	Duration   time.Duration
+	Extensions map[string]int64 // File count per lowercased extension
+
+	// Digest is set for canonical snapshots only, see Tree.Digest
+	Digest []byte
+
+	// Checksum of the stream up to the footer, and its optional signature,
+	// see sign.go
+	Checksum  []byte
+	Signature []byte
+	SignerKey ed25519.PublicKey
+}
+
+func NewFooter() *Footer {
+	return &Footer{Extensions: make(map[string]int64)}
+}
+
+// Account a node in the statistics
+func (f *Footer) Account(n *Node) {
+	switch {
+	case n.Failed():
+		f.Errors++
+	case n.Mode.IsDir():
+		f.Dirs++
+	default:
+		f.Files++
+		f.Bytes += n.Size
+		f.Extensions[strings.ToLower(filepath.Ext(n.Name))]++
+	}
+}
+
+// Throughput in bytes hashed per second
+func (f *Footer) Throughput() ByteSize {
+	if f.Duration <= 0 {
+		return 0
+	}
+	return ByteSize(float64(f.Bytes) / f.Duration.Seconds())
+}
+
+func (f *Footer) String() string {
+	return fmt.Sprintf("%d files, %d dirs totalling %s", f.Files, f.Dirs, ByteSize(f.Bytes))
+}
+
+// writeFooter appends the footer and its trailer to a node stream
+func writeFooter(w io.Writer, f *Footer) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		return err
+	}
+	var tail [8]byte
+	binary.BigEndian.PutUint64(tail[:], uint64(buf.Len()))
+	buf.Write(tail[:])
+	buf.WriteString(footerMagic)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// footerSize is the size of the footer ending b along with its trailer, 0
+// when b does not end with a whole footer
+func footerSize(b []byte) int {
+	if len(b) < footerTrailerSize || string(b[len(b)-len(footerMagic):]) != footerMagic {
+		return 0
+	}
+	size := binary.BigEndian.Uint64(b[len(b)-footerTrailerSize:])
+	if size > uint64(len(b)-footerTrailerSize) {
+		return 0
+	}
+	return int(size) + footerTrailerSize
+}
+
+// readFooter reads a footer and its trailer right after the end of nodes
+func readFooter(r *bufio.Reader) (*Footer, error) {
+	f := new(Footer)
+	if err := gob.NewDecoder(r).Decode(f); err != nil {
+		return nil, err
+	}
+	var tail [footerTrailerSize]byte
+	if _, err := io.ReadFull(r, tail[:]); err != nil {
+		return nil, err
+	}
+	if string(tail[8:]) != footerMagic {
+		return nil, fmt.Errorf("%w: bad footer trailer", ErrCorrupt)
+	}
+	return f, nil
+}
+
+// maxFooterSize bounds what is kept of compressed snapshots when looking for
+// their footer
+const maxFooterSize = 1 << 20
+
+// ReadFooter seeks the end of a snapshot to read its footer, without decoding
+// any node. Compressed snapshots keep their footer uncompressed after the
+// compressed stream, see Compression. Encrypted snapshots and compressed ones
+// of older versions cannot be seeked, they get decompressed up to their end
+// instead: the footer is kept within encryption, so that nothing of an
+// encrypted snapshot is readable without its key. Reading it costs a pass
+// over the whole snapshot, though nodes are still not decoded. Encrypted
+// snapshots are opened with ids.
+func ReadFooter(r io.ReadSeeker, ids ...Identity) (*Footer, error) {
+	var head [len(cryptMagic)]byte
+	n, _ := io.ReadFull(r, head[:])
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(head[:n]) {
+		f, err := readPlainFooter(r)
+		if err != ErrNoFooter || detect(head[:n]) == CompressNone {
+			return f, err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	dr, _, err := Decompress(r, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	tail := &tailBuffer{max: maxFooterSize}
+	if _, err := io.Copy(tail, dr); err != nil {
+		return nil, err
+	}
+	return readPlainFooter(bytes.NewReader(tail.buf))
+}
+
+func readPlainFooter(r io.ReadSeeker) (*Footer, error) {
+	var tail [footerTrailerSize]byte
+	end, err := r.Seek(-int64(len(tail)), io.SeekEnd)
+	if err != nil {
+		return nil, ErrNoFooter // too small
+	}
+	if _, err := io.ReadFull(r, tail[:]); err != nil {
+		return nil, err
+	}
+	if string(tail[8:]) != footerMagic {
+		return nil, ErrNoFooter
+	}
+	size := int64(binary.BigEndian.Uint64(tail[:8]))
+	if size > end {
+		return nil, fmt.Errorf("bad footer length %d", size)
+	}
+	if _, err := r.Seek(end-size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	f := new(Footer)
+	if err := gob.NewDecoder(io.LimitReader(r, size)).Decode(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ScanFooter rebuilds what it can of a Footer by decoding every node, for
+// snapshots without one.
+func ScanFooter(dec *gob.Decoder) (*Footer, error) {
+	f := NewFooter()
+	err := DecodeNodes(dec, func(n *Node) error {
+		f.Account(n)
+		return nil
+	})
+	return f, err
+}
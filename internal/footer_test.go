@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestFooter(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/d2", 0777))
+	is.NoErr(rootFS.WriteFile("d1/d2/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/d2/f2.JPG", []byte("defg"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/empty.txt", []byte{}, 0755))
+
+	FS = rootFS
+
+	var buf bytes.Buffer
+	Snapshot("d1", &buf, io.Discard, SnapshotOptions{})
+
+	ft, err := ReadFooter(bytes.NewReader(buf.Bytes()))
+	is.NoErr(err)
+	is.Equal(ft.Files, int64(2))
+	is.Equal(ft.Dirs, int64(2))
+	is.Equal(ft.Bytes, int64(7))
+	is.Equal(ft.Skipped, int64(1))
+	is.Equal(ft.Extensions, map[string]int64{".txt": 1, ".jpg": 1})
+	is.True(ft.Digest == nil)
+
+	tr, err := ReadTree(bytes.NewReader(buf.Bytes()))
+	is.NoErr(err)
+	is.Equal(tr.Footer, ft)
+
+	// Scanning gets the same counts
+	dec := gob.NewDecoder(bytes.NewReader(buf.Bytes()))
+	is.NoErr(dec.Decode(new(Info)))
+	scan, err := ScanFooter(dec)
+	is.NoErr(err)
+	is.Equal(scan.Bytes, ft.Bytes)
+	is.Equal(scan.Extensions, ft.Extensions)
+}
+
+func TestNoFooter(t *testing.T) {
+	is := is.New(t)
+
+	// A version 1 snapshot, nodes up to EOF
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	is.NoErr(enc.Encode(Info{Version: 1}))
+	is.NoErr(enc.Encode(Node{Name: "root", Mode: fs.ModeDir | 0777}))
+	is.NoErr(enc.Encode(Node{ID: 1, Name: "f1.txt", Size: 3}))
+
+	_, err := ReadFooter(bytes.NewReader(buf.Bytes()))
+	is.Equal(err, ErrNoFooter)
+
+	tr, err := ReadTree(bytes.NewReader(buf.Bytes()))
+	is.NoErr(err)
+	is.True(tr.Footer == nil)
+	is.Equal(tr.Node(1).Name, "f1.txt")
+}
+
+func TestIntegrity(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+	is.NoErr(rootFS.MkdirAll("d1/d2", 0777))
+	for _, f := range []string{"d1/a.txt", "d1/d2/b.txt", "d1/d2/c.txt"} {
+		is.NoErr(rootFS.WriteFile(f, []byte(f), 0755))
+	}
+	FS = rootFS
+
+	for _, c := range []Compression{CompressNone, CompressGzip, CompressZstd} {
+		var buf bytes.Buffer
+		Snapshot("d1", &buf, io.Discard, SnapshotOptions{Compression: c})
+		b := buf.Bytes()
+
+		tr, err := ReadTree(bytes.NewReader(b))
+		is.NoErr(err)
+		is.Equal(tr.Integrity, Complete)
+
+		// Cut anywhere, even right before the footer
+		for _, cut := range []int{len(b) / 3, len(b) - 30, len(b) - 1} {
+			tr, err = ReadTree(bytes.NewReader(b[:cut]))
+			is.True(errors.Is(err, ErrTruncated)) // truncated
+			is.Equal(tr.Integrity, Truncated)
+		}
+	}
+
+	// A flipped byte in a file name gets past gob, not the checksum
+	var buf bytes.Buffer
+	Snapshot("d1", &buf, io.Discard, SnapshotOptions{})
+	b := buf.Bytes()
+	i := bytes.Index(b, []byte("c.txt"))
+	is.True(i > 0)
+	b[i] = 'x'
+	tr, err := ReadTree(bytes.NewReader(b))
+	is.Equal(err, ErrChecksum)
+	is.Equal(tr.Integrity, Corrupt)
+	is.Equal(len(tr.nodes), 5) // nodes are still there
+}
+
+func TestTruncatedTree(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+	for i := 0; i < 50; i++ {
+		d := fmt.Sprintf("d1/d%d", i%5)
+		is.NoErr(rootFS.MkdirAll(d, 0777))
+		is.NoErr(rootFS.WriteFile(fmt.Sprintf("%s/f%d.txt", d, i), []byte(d), 0755))
+	}
+	FS = rootFS
+
+	for _, c := range []Compression{CompressNone, CompressZstd} {
+		var buf bytes.Buffer
+		Snapshot("d1", &buf, io.Discard, SnapshotOptions{Compression: c})
+		b := buf.Bytes()
+
+		tr, err := ReadTree(bytes.NewReader(b[:len(b)/2]))
+		is.True(errors.Is(err, ErrTruncated))
+		is.Equal(tr.Integrity, Truncated)
+
+		// What is left hangs from the root, directories have no hash as
+		// their content is not fully known. Compressed blocks cut short
+		// give nothing.
+		if c == CompressZstd {
+			continue
+		}
+		is.True(len(tr.nodes) > 0)
+		is.NoErr(tr.Walk(func(path string, n *Node) error {
+			is.Equal(tr.Search(path), n)
+			if n.Mode.IsDir() {
+				is.Equal(n.Hash, [sha1.Size]byte{})
+			}
+			return nil
+		}))
+	}
+
+	// Nodes written before their parent are dropped along with it
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	is.NoErr(enc.Encode(Info{Version: VERSION}))
+	is.NoErr(enc.Encode(Node{Name: "root", Mode: fs.ModeDir | 0777}))
+	is.NoErr(enc.Encode(Node{ID: 2, ParentID: 1, Name: "f2.txt", Size: 3}))
+	tr, err := ReadTree(bytes.NewReader(buf.Bytes()))
+	is.True(errors.Is(err, ErrTruncated))
+	is.True(tr.Node(2) == nil)
+	is.True(tr.Search("f2.txt") == nil)
+}
@@ -0,0 +1,404 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// INDEX_SUFFIX is appended to a snapshot path to name its index
+const INDEX_SUFFIX = ".idx"
+
+const indexMagic = "hsnapIDX"
+const indexVersion = 3
+
+// ErrStaleIndex is returned when an index does not belong to its snapshot
+var ErrStaleIndex = errors.New("index does not match snapshot")
+
+// An index is a companion file to a snapshot, allowing path, id and hash
+// lookups without decoding the whole snapshot. Snapshots stay a plain stream,
+// the index is built afterward with WriteIndex. Layout is:
+//
+//	header   magic, version, snapshot nonce, node count
+//	records  one per node, sorted by path, see indexRecord
+//	paths    offset of each record (uint64), same order
+//	ids      (id int64, position uint64) sorted by id
+//	hashes   (hash, position uint64) sorted by hash, files only
+//	trailer  offsets of the three tables, hash count, magic
+//
+// Sorting by path puts a directory right before its descendants, so that
+// listing a directory only reads its direct children by skipping over
+// subtrees.
+type indexHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Nonce   uuid.UUID
+	Count   uint64
+}
+
+type indexTrailer struct {
+	Paths, IDs, Hashes uint64
+	HashCount          uint64
+	Magic              [8]byte
+}
+
+// indexRecord is followed by the relative path, the name and the error
+type indexRecord struct {
+	ID, ParentID int64
+	Mode         uint32
+	Size         int64
+	ModTime      int64 // unix nanoseconds, 0 when unknown
+	Hash         [sha1.Size]byte
+	Files, Bytes int64 // DirStats of directories
+	Descendants  uint64
+	PathLen      uint32
+	NameLen      uint32
+	ErrLen       uint32
+}
+
+const (
+	idEntrySize   = 16
+	hashEntrySize = sha1.Size + 8
+)
+
+var recordSize = int64(binary.Size(indexRecord{}))
+
+// IndexPath names the index of the snapshot at path
+func IndexPath(path string) string {
+	return path + INDEX_SUFFIX
+}
+
+// WriteIndex of a Tree
+func WriteIndex(t *Tree, w io.Writer) error {
+	ns := t.sorted()
+
+	// Children come after their parent, count descendants backward
+	pos := make(map[int]int, len(ns))
+	for i, n := range ns {
+		pos[n.ID] = i
+	}
+	desc := make([]uint64, len(ns))
+	for i := len(ns) - 1; i > 0; i-- {
+		if p, ok := pos[ns[i].ParentID]; ok && p != i {
+			desc[p] += 1 + desc[i]
+		}
+	}
+
+	var off int64
+	write := func(data interface{}) error {
+		if err := binary.Write(w, binary.BigEndian, data); err != nil {
+			return err
+		}
+		off += int64(binary.Size(data))
+		return nil
+	}
+
+	h := indexHeader{Version: indexVersion, Nonce: t.Info.Nonce, Count: uint64(len(ns))}
+	copy(h.Magic[:], indexMagic)
+	if err := write(h); err != nil {
+		return err
+	}
+
+	offsets := make([]uint64, len(ns))
+	for i, n := range ns {
+		offsets[i] = uint64(off)
+		path := t.RelPath(n)
+		st := t.DirStats(n)
+		rec := indexRecord{
+			ID:          int64(n.ID),
+			ParentID:    int64(n.ParentID),
+			Mode:        uint32(n.Mode),
+			Size:        n.Size,
+			ModTime:     unixNano(n.ModTime),
+			Hash:        n.Hash,
+			Files:       st.Files,
+			Bytes:       st.Bytes,
+			Descendants: desc[i],
+			PathLen:     uint32(len(path)),
+			NameLen:     uint32(len(n.Name)),
+			ErrLen:      uint32(len(n.Err)),
+		}
+		if err := write(rec); err != nil {
+			return err
+		}
+		if err := write([]byte(path + n.Name + n.Err)); err != nil {
+			return err
+		}
+	}
+
+	tr := indexTrailer{Paths: uint64(off)}
+	copy(tr.Magic[:], indexMagic)
+	if err := write(offsets); err != nil {
+		return err
+	}
+
+	tr.IDs = uint64(off)
+	ids := make([]int, len(ns))
+	for i := range ids {
+		ids[i] = i
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ns[ids[a]].ID < ns[ids[b]].ID
+	})
+	for _, i := range ids {
+		if err := write([2]uint64{uint64(ns[i].ID), uint64(i)}); err != nil {
+			return err
+		}
+	}
+
+	tr.Hashes = uint64(off)
+	var files []int
+	for i, n := range ns {
+		if !n.Mode.IsDir() && !n.Failed() {
+			files = append(files, i)
+		}
+	}
+	sort.SliceStable(files, func(a, b int) bool {
+		return bytes.Compare(ns[files[a]].Hash[:], ns[files[b]].Hash[:]) < 0
+	})
+	for _, i := range files {
+		if err := write(ns[i].Hash); err != nil {
+			return err
+		}
+		if err := write(uint64(i)); err != nil {
+			return err
+		}
+	}
+	tr.HashCount = uint64(len(files))
+
+	return write(tr)
+}
+
+// Index gives random access to a snapshot through its index file
+type Index struct {
+	Nonce uuid.UUID
+
+	f     *os.File
+	count int
+	tr    indexTrailer
+}
+
+// OpenIndex opens the index of the snapshot whose Info is given
+func OpenIndex(path string, info *Info) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	x := &Index{f: f}
+	if err := x.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if info != nil && x.Nonce != info.Nonce {
+		f.Close()
+		return nil, ErrStaleIndex
+	}
+	return x, nil
+}
+
+func (x *Index) load() error {
+	var h indexHeader
+	if err := binary.Read(io.NewSectionReader(x.f, 0, 1<<62), binary.BigEndian, &h); err != nil {
+		return err
+	}
+	if string(h.Magic[:]) != indexMagic {
+		return errors.New("not an index file")
+	}
+	if h.Version != indexVersion {
+		return fmt.Errorf("index version %d is outdated, rebuild it", h.Version)
+	}
+	st, err := x.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := int64(binary.Size(x.tr))
+	if err := binary.Read(io.NewSectionReader(x.f, st.Size()-size, size), binary.BigEndian, &x.tr); err != nil {
+		return err
+	}
+	if string(x.tr.Magic[:]) != indexMagic {
+		return errors.New("truncated index file")
+	}
+	x.Nonce = h.Nonce
+	x.count = int(h.Count)
+	return nil
+}
+
+func (x *Index) Close() error {
+	return x.f.Close()
+}
+
+// Len is the count of indexed nodes
+func (x *Index) Len() int {
+	return x.count
+}
+
+func (x *Index) readUint64(off int64) (uint64, error) {
+	var buf [8]byte
+	if _, err := x.f.ReadAt(buf[:], off); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// at reads the record at position i in path order, along with its
+// descendants count
+func (x *Index) at(i int) (Entry, int, error) {
+	off, err := x.readUint64(int64(x.tr.Paths) + int64(i)*8)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	var rec indexRecord
+	if err := binary.Read(io.NewSectionReader(x.f, int64(off), recordSize), binary.BigEndian, &rec); err != nil {
+		return Entry{}, 0, err
+	}
+	buf := make([]byte, rec.PathLen+rec.NameLen+rec.ErrLen)
+	if _, err := x.f.ReadAt(buf, int64(off)+recordSize); err != nil {
+		return Entry{}, 0, err
+	}
+	n := &Node{
+		ID:       int(rec.ID),
+		ParentID: int(rec.ParentID),
+		Mode:     os.FileMode(rec.Mode),
+		Size:     rec.Size,
+		Hash:     rec.Hash,
+		Name:     string(buf[rec.PathLen : rec.PathLen+rec.NameLen]),
+		Err:      string(buf[rec.PathLen+rec.NameLen:]),
+	}
+	if rec.ModTime != 0 {
+		n.ModTime = time.Unix(0, rec.ModTime)
+	}
+	e := Entry{NodeP: NodeP{Node: n, Path: string(buf[:rec.PathLen])}}
+	if n.Mode.IsDir() {
+		e.Stats = DirStats{Files: rec.Files, Bytes: rec.Bytes}
+	}
+	return e, int(rec.Descendants), nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// find the position of a relative path, or -1
+func (x *Index) find(path string) (i int, err error) {
+	path = filepath.Clean("/" + path)[1:]
+	key := pathKey(path)
+	i = sort.Search(x.count, func(i int) bool {
+		var p Entry
+		if err == nil {
+			p, _, err = x.at(i)
+		}
+		return pathKey(p.Path) >= key
+	})
+	if err != nil || i == x.count {
+		return -1, err
+	}
+	e, _, err := x.at(i)
+	if err != nil || e.Path != path {
+		return -1, err
+	}
+	return i, nil
+}
+
+// Search a node by relative path, returns a nil Node when not found
+func (x *Index) Search(path string) (Entry, error) {
+	i, err := x.find(path)
+	if err != nil || i < 0 {
+		return Entry{}, err
+	}
+	e, _, err := x.at(i)
+	return e, err
+}
+
+// ChildrenOf the node at relative path
+func (x *Index) ChildrenOf(path string) (es []Entry, err error) {
+	i, err := x.find(path)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	_, desc, err := x.at(i)
+	if err != nil {
+		return nil, err
+	}
+	for j := i + 1; j <= i+desc; {
+		c, d, err := x.at(j)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, c)
+		j += 1 + d
+	}
+	return
+}
+
+// Node finds a node by id, returns a nil Node when not found
+func (x *Index) Node(id int) (NodeP, error) {
+	base := int64(x.tr.IDs)
+	var err error
+	i := sort.Search(x.count, func(i int) bool {
+		var v uint64
+		if err == nil {
+			v, err = x.readUint64(base + int64(i)*idEntrySize)
+		}
+		return int64(v) >= int64(id)
+	})
+	if err != nil || i == x.count {
+		return NodeP{}, err
+	}
+	v, err := x.readUint64(base + int64(i)*idEntrySize)
+	if err != nil || int(int64(v)) != id {
+		return NodeP{}, err
+	}
+	pos, err := x.readUint64(base + int64(i)*idEntrySize + 8)
+	if err != nil {
+		return NodeP{}, err
+	}
+	e, _, err := x.at(int(pos))
+	return e.NodeP, err
+}
+
+// Hash finds all files with the given hash
+func (x *Index) Hash(h [sha1.Size]byte) (nps []NodeP, err error) {
+	base := int64(x.tr.Hashes)
+	n := int(x.tr.HashCount)
+	hashAt := func(i int) (e [hashEntrySize]byte, err error) {
+		_, err = x.f.ReadAt(e[:], base+int64(i)*hashEntrySize)
+		return
+	}
+	i := sort.Search(n, func(i int) bool {
+		var e [hashEntrySize]byte
+		if err == nil {
+			e, err = hashAt(i)
+		}
+		return bytes.Compare(e[:sha1.Size], h[:]) >= 0
+	})
+	for ; err == nil && i < n; i++ {
+		var e [hashEntrySize]byte
+		if e, err = hashAt(i); err != nil || !bytes.Equal(e[:sha1.Size], h[:]) {
+			break
+		}
+		var c Entry
+		if c, _, err = x.at(int(binary.BigEndian.Uint64(e[sha1.Size:]))); err == nil {
+			nps = append(nps, c.NodeP)
+		}
+	}
+	return
+}
+
+// pathKey makes paths sort as in a depth first traversal, the separator
+// sorting before any other character.
+func pathKey(path string) string {
+	return strings.ReplaceAll(path, string(filepath.Separator), "\x00")
+}
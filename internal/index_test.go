@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestIndex(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/a/b", 0777))
+	is.NoErr(rootFS.MkdirAll("d1/a.b", 0777))
+	is.NoErr(rootFS.WriteFile("d1/a/b/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/a/f2.txt", []byte("def"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/a.b/f3.txt", []byte("abc"), 0755)) // == f1
+	is.NoErr(rootFS.WriteFile("d1/f4.txt", []byte("ghi"), 0755))
+
+	FS = rootFS
+
+	tr := readTree(is, "d1")
+
+	path := filepath.Join(t.TempDir(), "snap.idx")
+	f, err := os.Create(path)
+	is.NoErr(err)
+	is.NoErr(WriteIndex(tr, f))
+	is.NoErr(f.Close())
+
+	x, err := OpenIndex(path, tr.Info)
+	is.NoErr(err)
+	defer x.Close()
+	is.Equal(x.Len(), 8)
+
+	// Directories carry their stats
+	dir, err := x.Search("a")
+	is.NoErr(err)
+	is.Equal(dir.Stats, DirStats{Files: 2, Bytes: 6})
+
+	e, err := x.Search("a/b/f1.txt")
+	is.NoErr(err)
+	is.Equal(e.Node.Name, "f1.txt")
+	is.Equal(e.Node.ID, tr.Search("a/b/f1.txt").ID)
+
+	e, err = x.Search("a/nope")
+	is.NoErr(err)
+	is.True(e.Node == nil)
+
+	names := func(nps []NodeP) (ns []string) {
+		for _, np := range nps {
+			ns = append(ns, np.Path)
+		}
+		sort.Strings(ns)
+		return
+	}
+
+	children := func(path string) []NodeP {
+		es, err := x.ChildrenOf(path)
+		is.NoErr(err)
+		var nps []NodeP
+		for _, e := range es {
+			nps = append(nps, e.NodeP)
+		}
+		return nps
+	}
+	is.Equal(names(children("")), []string{"a", "a.b", "f4.txt"})
+	is.Equal(names(children("a")), []string{"a/b", "a/f2.txt"})
+
+	for _, n := range tr.nodes {
+		np, err := x.Node(n.ID)
+		is.NoErr(err)
+		is.Equal(np.Path, tr.RelPath(n))
+	}
+	np, err := x.Node(1000)
+	is.NoErr(err)
+	is.True(np.Node == nil)
+
+	nps, err := x.Hash(tr.Search("a/b/f1.txt").Hash)
+	is.NoErr(err)
+	is.Equal(names(nps), []string{"a.b/f3.txt", "a/b/f1.txt"})
+
+	// An index only serves its own snapshot
+	_, err = OpenIndex(path, readTree(is, "d1").Info)
+	is.Equal(err, ErrStaleIndex)
+}
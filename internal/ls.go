@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Lister browses a snapshot by relative path, either through its Index or
+// through a Tree read in memory, see TreeLister.
+type Lister interface {
+	// Search a node by relative path, returns a nil Node when not found
+	Search(path string) (Entry, error)
+	// ChildrenOf the node at relative path
+	ChildrenOf(path string) ([]Entry, error)
+	// Dups counts the other files sharing the content of n
+	Dups(n *Node) (int, error)
+}
+
+var _ Lister = &Index{}
+
+// Entry of a listing, a node along with the stats of its content for
+// directories
+type Entry struct {
+	NodeP
+	Stats DirStats
+}
+
+// Dups counts the other files sharing the content of n. Empty and unreadable
+// files have no duplicates.
+func (x *Index) Dups(n *Node) (int, error) {
+	if !dupable(n) {
+		return 0, nil
+	}
+	nps, err := x.Hash(n.Hash)
+	if err != nil {
+		return 0, err
+	}
+	c := 0
+	for _, np := range nps {
+		if np.Node.ID != n.ID && dupable(np.Node) {
+			c++
+		}
+	}
+	return c, nil
+}
+
+func dupable(n *Node) bool {
+	return !n.Mode.IsDir() && !n.Failed() && n.Size > 0
+}
+
+// TreeLister browses a tree read in memory
+func TreeLister(t *Tree) Lister {
+	return &treeLister{t: t}
+}
+
+type treeLister struct {
+	t      *Tree
+	hashes HashGroup
+}
+
+func (l *treeLister) entry(n *Node) Entry {
+	return Entry{NodeP: NodeP{Node: n, Path: l.t.RelPath(n)}, Stats: l.t.DirStats(n)}
+}
+
+func (l *treeLister) Search(path string) (Entry, error) {
+	n := l.t.Search(path)
+	if n == nil {
+		return Entry{}, nil
+	}
+	return l.entry(n), nil
+}
+
+func (l *treeLister) ChildrenOf(path string) (es []Entry, err error) {
+	n := l.t.Search(path)
+	if n == nil {
+		return nil, nil
+	}
+	for _, c := range l.t.ChildrenOf(n) {
+		es = append(es, l.entry(c))
+	}
+	return
+}
+
+func (l *treeLister) Dups(n *Node) (int, error) {
+	if !dupable(n) {
+		return 0, nil
+	}
+	if l.hashes == nil {
+		l.hashes = make(HashGroup)
+		for _, x := range l.t.nodes {
+			if dupable(x) {
+				l.hashes.Add(x)
+			}
+		}
+	}
+	return len(l.hashes[n.Hash]) - 1, nil
+}
+
+// Glob lists the nodes matching pattern, as understood by filepath.Match,
+// each path element being matched in turn. A pattern without meta characters
+// is a plain Search. Matches are sorted by path.
+func Glob(l Lister, pattern string) ([]Entry, error) {
+	pattern = filepath.Clean("/" + pattern)[1:]
+	if !hasMeta(pattern) {
+		e, err := l.Search(pattern)
+		if err != nil || e.Node == nil {
+			return nil, err
+		}
+		return []Entry{e}, nil
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%s: %w", pattern, err)
+	}
+
+	dirs := []string{""}
+	var es []Entry
+	elems := strings.Split(pattern, string(filepath.Separator))
+	for i, elem := range elems {
+		var next []string
+		es = nil
+		for _, dir := range dirs {
+			cs, err := l.ChildrenOf(dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range cs {
+				if ok, _ := filepath.Match(elem, c.Node.Name); !ok {
+					continue
+				}
+				if i < len(elems)-1 && !c.Node.Mode.IsDir() {
+					continue
+				}
+				next = append(next, c.Path)
+				es = append(es, c)
+			}
+		}
+		dirs = next
+	}
+	sort.Slice(es, func(i, j int) bool { return pathKey(es[i].Path) < pathKey(es[j].Path) })
+	return es, nil
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// ListOrder of nodes within a directory listing
+type ListOrder string
+
+const (
+	ByName ListOrder = "name"
+	BySize ListOrder = "size"
+	ByTime ListOrder = "time"
+)
+
+// SortListing puts directories first, then sorts by name, by decreasing size
+// or newest first. Directories are sized after their content. Ties are sorted
+// by name.
+func SortListing(es []Entry, by ListOrder) {
+	sort.SliceStable(es, func(i, j int) bool {
+		a, b := es[i], es[j]
+		if ad, bd := a.Node.Mode.IsDir(), b.Node.Mode.IsDir(); ad != bd {
+			return ad
+		}
+		switch by {
+		case BySize:
+			if sa, sb := a.Size(), b.Size(); sa != sb {
+				return sa > sb
+			}
+		case ByTime:
+			if !a.Node.ModTime.Equal(b.Node.ModTime) {
+				return a.Node.ModTime.After(b.Node.ModTime)
+			}
+		}
+		return a.Node.Name < b.Node.Name
+	})
+}
+
+// Size of a node, the size of its content for directories
+func (e Entry) Size() int64 {
+	if e.Node.Mode.IsDir() {
+		return e.Stats.Bytes
+	}
+	return e.Node.Size
+}
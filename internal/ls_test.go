@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestListing(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/photos/2020", 0777))
+	is.NoErr(rootFS.MkdirAll("d1/docs", 0777))
+	is.NoErr(rootFS.WriteFile("d1/photos/2020/a.jpg", []byte("aaaaaaaa"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/photos/b.jpg", []byte("bbbb"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/docs/c.txt", []byte("bbbb"), 0755)) // == b.jpg
+	is.NoErr(rootFS.WriteFile("d1/a.txt", []byte("d"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/z.txt", []byte("eeeeeeeeeeeeeeeeeeee"), 0755))
+
+	FS = rootFS
+	tr := readTree(is, "d1")
+
+	path := filepath.Join(t.TempDir(), "snap.idx")
+	f, err := os.Create(path)
+	is.NoErr(err)
+	is.NoErr(WriteIndex(tr, f))
+	is.NoErr(f.Close())
+	x, err := OpenIndex(path, tr.Info)
+	is.NoErr(err)
+	defer x.Close()
+
+	paths := func(es []Entry) (ps []string) {
+		for _, e := range es {
+			ps = append(ps, e.Path)
+		}
+		return
+	}
+
+	// Both listers agree
+	for _, l := range []Lister{TreeLister(tr), x} {
+		cs, err := l.ChildrenOf("")
+		is.NoErr(err)
+		SortListing(cs, ByName)
+		is.Equal(paths(cs), []string{"docs", "photos", "a.txt", "z.txt"})
+		SortListing(cs, BySize)
+		is.Equal(paths(cs), []string{"photos", "docs", "z.txt", "a.txt"})
+
+		es, err := Glob(l, "*/*.jpg")
+		is.NoErr(err)
+		is.Equal(paths(es), []string{"photos/b.jpg"})
+		es, err = Glob(l, "p*/*/*")
+		is.NoErr(err)
+		is.Equal(paths(es), []string{"photos/2020/a.jpg"})
+		es, err = Glob(l, "docs")
+		is.NoErr(err)
+		is.Equal(paths(es), []string{"docs"})
+		is.Equal(es[0].Stats, DirStats{Files: 1, Bytes: 4})
+		es, err = Glob(l, "nope*")
+		is.NoErr(err)
+		is.Equal(len(es), 0)
+		_, err = Glob(l, "[")
+		is.True(err != nil)
+
+		c, err := l.Dups(tr.Search("photos/b.jpg"))
+		is.NoErr(err)
+		is.Equal(c, 1)
+		c, err = l.Dups(tr.Search("a.txt"))
+		is.NoErr(err)
+		is.Equal(c, 0)
+	}
+
+	now := time.Now()
+	es := []Entry{
+		{NodeP: NodeP{Node: &Node{Name: "old", ModTime: now.Add(-time.Hour)}}},
+		{NodeP: NodeP{Node: &Node{Name: "new", ModTime: now}}},
+		{NodeP: NodeP{Node: &Node{Name: "dir", Mode: os.ModeDir, ModTime: now.Add(-2 * time.Hour)}}},
+	}
+	SortListing(es, ByTime)
+	is.Equal(es[0].Node.Name, "dir")
+	is.Equal(es[1].Node.Name, "new")
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A catalog is a snapshot merging others, each of them becoming a subtree of
+// the catalog root. The Info of every merged snapshot is kept in the catalog
+// Info, along with the id of its subtree root:
+//
+//	root (id 0)
+//	├── nas-photos    Sources[0], the root of a first snapshot
+//	└── disk2-backup  Sources[1]
+//
+// Merging catalogs flattens them, a catalog never nests another one.
+
+// Source is a snapshot merged into a catalog
+type Source struct {
+	Info
+	RootID int // id of its subtree root within the catalog
+}
+
+// IsCatalog tells whether the snapshot is made of merged snapshots
+func (i *Info) IsCatalog() bool {
+	return len(i.Sources) > 0
+}
+
+// Nonces of the snapshot, and of its sources for a catalog
+func (t *Tree) Nonces() []uuid.UUID {
+	ns := []uuid.UUID{t.Info.Nonce}
+	for _, s := range t.Info.Sources {
+		ns = append(ns, s.Nonce)
+	}
+	return ns
+}
+
+// Overlaps tells whether both trees share a snapshot, which happens when one
+// is a catalog including the other, or when one is extracted from the other.
+func (t *Tree) Overlaps(x *Tree) bool {
+	for _, a := range t.lineage() {
+		for _, b := range x.Nonces() {
+			if a == b {
+				return true
+			}
+		}
+	}
+	for _, a := range t.Nonces() {
+		for _, b := range x.lineage() {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lineage of the snapshot: its nonces and the ones it was extracted from
+func (t *Tree) lineage() []uuid.UUID {
+	ns := append(t.Nonces(), t.Info.DerivedFrom...)
+	for _, s := range t.Info.Sources {
+		ns = append(ns, s.DerivedFrom...)
+	}
+	return ns
+}
+
+// Source of a node, nil for nodes of plain snapshots and for the catalog
+// root itself. Resolved sources are cached.
+func (t *Tree) Source(n *Node) *Source {
+	if !t.Info.IsCatalog() {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sources == nil {
+		t.sources = make(map[int]*Source, len(t.nodes))
+		for i := range t.Info.Sources {
+			t.sources[t.Info.Sources[i].RootID] = &t.Info.Sources[i]
+		}
+	}
+	return t.source(n)
+}
+
+func (t *Tree) source(n *Node) *Source {
+	if s, ok := t.sources[n.ID]; ok {
+		return s
+	}
+	root := t.Root()
+	if n == root {
+		return nil
+	}
+	p, ok := t.nodes[n.ParentID]
+	if !ok || p == root {
+		return nil
+	}
+	s := t.source(p)
+	t.sources[n.ID] = s
+	return s
+}
+
+// subtree of a snapshot to be merged, with its Info
+type subtree struct {
+	info Info
+	tree *Tree
+	root *Node
+}
+
+// subtrees of a snapshot, one per source for a catalog
+func subtrees(t *Tree) (sts []subtree) {
+	if !t.Info.IsCatalog() {
+		return []subtree{{*t.Info, t, t.Root()}}
+	}
+	for _, s := range t.Info.Sources {
+		if n, ok := t.nodes[s.RootID]; ok {
+			sts = append(sts, subtree{s.Info, t, n})
+		}
+	}
+	return
+}
+
+// sourceName names the subtree of a source after its host and root
+// directory, it has to be a valid file name.
+func sourceName(i Info) string {
+	name := filepath.Base(i.RootPath)
+	if name == "." || name == string(filepath.Separator) {
+		name = "root"
+	}
+	if i.Hostname != "" {
+		name = i.Hostname + "-" + name
+	}
+	return strings.ReplaceAll(name, string(filepath.Separator), "_")
+}
+
+// Merge snapshots into a catalog written to out. Snapshots are renumbered,
+// the catalog root having id 0, and a snapshot cannot be merged twice.
+func Merge(out io.Writer, opt SnapshotOptions, trees ...*Tree) error {
+	if len(trees) == 0 {
+		return errors.New("nothing to merge")
+	}
+	var sts []subtree
+	var skipped int64
+	seen := make(map[uuid.UUID]bool)
+	for _, t := range trees {
+		if t.Footer != nil {
+			skipped += t.Footer.Skipped
+		}
+		for _, st := range subtrees(t) {
+			if seen[st.info.Nonce] {
+				return fmt.Errorf("%s is merged twice", &st.info)
+			}
+			seen[st.info.Nonce] = true
+			st.info.Sources = nil
+			sts = append(sts, st)
+		}
+	}
+
+	hs, err := os.Hostname()
+	if err != nil {
+		hs = "localhost"
+	}
+	info := Info{
+		Version:   VERSION,
+		CreatedAt: time.Now(),
+		Nonce:     uuid.New(),
+		Hostname:  hs,
+	}
+
+	id := 1
+	names := make(map[string]int)
+	for _, st := range sts {
+		info.Sources = append(info.Sources, Source{Info: st.info, RootID: id})
+		id += st.tree.count(st.root)
+		names[sourceName(st.info)]++
+	}
+
+	sw, err := newSnapshotWriter(out, info, opt)
+	if err != nil {
+		return err
+	}
+	if err := sw.Write(&Node{Name: "catalog", Mode: os.ModeDir | 0755}); err != nil {
+		return err
+	}
+
+	id = 1
+	used := make(map[string]int)
+	for _, st := range sts {
+		name := sourceName(st.info)
+		if names[name] > 1 {
+			used[name]++
+			name = fmt.Sprintf("%s-%d", name, used[name])
+		}
+
+		if err := writeSubtree(sw, st.tree, st.root, name, 0, &id); err != nil {
+			return err
+		}
+	}
+	sw.footer.Skipped = skipped
+	return sw.Close()
+}
+
+// writeSubtree renumbers the subtree rooted at root from id onward, and
+// writes it. The root is renamed name, and gets parent as its parent.
+func writeSubtree(sw *snapshotWriter, t *Tree, root *Node, name string, parent int, id *int) error {
+	ids := make(map[int]int)
+	return t.WalkFrom(root, func(_ string, n *Node) error {
+		m := *n
+		m.tree = nil
+		m.ID, ids[n.ID] = *id, *id
+		*id++
+		if n == root {
+			m.Name, m.ParentID = name, parent
+		} else {
+			m.ParentID = ids[n.ParentID]
+		}
+		return sw.Write(&m)
+	})
+}
+
+// count nodes of the subtree rooted at n
+func (t *Tree) count(n *Node) (c int) {
+	t.WalkFrom(n, func(string, *Node) error {
+		c++
+		return nil
+	})
+	return
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestMerge(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("disk1/photos", 0777))
+	is.NoErr(rootFS.MkdirAll("disk2/photos", 0777))
+	is.NoErr(rootFS.MkdirAll("disk3", 0777))
+	is.NoErr(rootFS.MkdirAll("local", 0777))
+	is.NoErr(rootFS.WriteFile("disk1/photos/a.jpg", []byte("aaa"), 0755))
+	is.NoErr(rootFS.WriteFile("disk2/photos/b.jpg", []byte("bbb"), 0755))
+	is.NoErr(rootFS.WriteFile("disk3/c.jpg", []byte("ccc"), 0755))
+	is.NoErr(rootFS.WriteFile("local/a.jpg", []byte("aaa"), 0755))
+	is.NoErr(rootFS.WriteFile("local/c.jpg", []byte("ccc"), 0755))
+
+	FS = rootFS
+
+	merge := func(ts ...*Tree) *Tree {
+		var buf bytes.Buffer
+		is.NoErr(Merge(&buf, SnapshotOptions{Compression: CompressGzip}, ts...))
+		c, err := ReadTree(&buf)
+		is.NoErr(err)
+		return c
+	}
+
+	t1, t2, t3 := readTree(is, "disk1"), readTree(is, "disk2"), readTree(is, "disk3")
+	c := merge(t1, t2)
+
+	is.True(c.Info.IsCatalog())
+	is.Equal(len(c.Info.Sources), 2)
+	is.Equal(c.Info.Sources[0].Nonce, t1.Info.Nonce)
+	is.Equal(c.Footer.Files, int64(2))
+
+	host := t1.Info.Hostname
+	n := c.Search(host + "-disk2/photos/b.jpg")
+	is.True(n != nil)
+	is.Equal(c.Source(n).Nonce, t2.Info.Nonce)
+	is.Equal(c.AbsPath(n), "disk2/photos/b.jpg")
+	is.True(c.Source(c.Root()) == nil)
+
+	// Catalogs are flattened when merged again, sources cannot repeat
+	c = merge(c, t3)
+	is.Equal(len(c.Info.Sources), 3)
+	is.Equal(c.Source(c.Search(host+"-disk3/c.jpg")).Nonce, t3.Info.Nonce)
+	is.True(Merge(io.Discard, SnapshotOptions{}, c, t1) != nil)
+
+	// Trimming against a catalog
+	local := readTree(is, "local")
+	matches := local.Trim(c)
+	matches.PruneSingleTreeGroups()
+	is.Equal(len(matches), 2)
+	is.True(c.Overlaps(t2))
+	is.True(!c.Overlaps(local))
+}
@@ -0,0 +1,126 @@
+//go:build linux || darwin || freebsd
+
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+// HashXattr is the extended attribute holding the hex hash of mounted files
+const HashXattr = "user.hsnap.sha1"
+
+// Mount serves t read-only on dir until it gets unmounted, see Unmount. Files
+// have the size, mode and modification time of their snapshot node but no
+// content, reading them gives nothing.
+func Mount(t *Tree, dir string) error {
+	c, err := fuse.Mount(dir,
+		fuse.ReadOnly(),
+		fuse.FSName("hsnap"),
+		fuse.Subtype("hsnap"),
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := fusefs.Serve(c, mountFS{t}); err != nil {
+		return err
+	}
+	<-c.Ready
+	return c.MountError
+}
+
+// Unmount dir, making a pending Mount return
+func Unmount(dir string) error {
+	return fuse.Unmount(dir)
+}
+
+type mountFS struct {
+	t *Tree
+}
+
+func (m mountFS) Root() (fusefs.Node, error) {
+	return mountNode{m.t.Root()}, nil
+}
+
+// mountNode is a file or directory of a mounted tree
+type mountNode struct {
+	n *Node
+}
+
+func (m mountNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = uint64(m.n.ID) + 1 // 0 is reserved
+	a.Mode = m.n.Mode
+	a.Size = uint64(m.n.Size)
+	a.Blocks = (a.Size + 511) / 512
+	a.Mtime = m.n.ModTime
+	a.Nlink = 1
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	return nil
+}
+
+func (m mountNode) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	// Through the path index, names like .. or a/b are no children of m
+	t := m.n.tree
+	c := t.Search(filepath.Join(t.RelPath(m.n), name))
+	if c == nil || c == m.n || c.ParentID != m.n.ID {
+		return nil, fuse.ENOENT
+	}
+	return mountNode{c}, nil
+}
+
+func (m mountNode) ReadDirAll(ctx context.Context) (ds []fuse.Dirent, err error) {
+	for _, c := range m.n.tree.ChildrenOf(m.n) {
+		d := fuse.Dirent{Inode: uint64(c.ID) + 1, Name: c.Name, Type: fuse.DT_File}
+		if c.Mode.IsDir() {
+			d.Type = fuse.DT_Dir
+		}
+		ds = append(ds, d)
+	}
+	return
+}
+
+func (m mountNode) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	// Bypassing the page cache, reads stop at the empty content rather
+	// than at the advertised size
+	if !m.n.Mode.IsDir() {
+		res.Flags |= fuse.OpenDirectIO
+	}
+	return m, nil
+}
+
+func (m mountNode) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
+	res.Data = res.Data[:0]
+	return nil
+}
+
+func (m mountNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, res *fuse.GetxattrResponse) error {
+	if req.Name != HashXattr || !m.hashed() {
+		return fuse.ErrNoXattr
+	}
+	res.Xattr = []byte(hex.EncodeToString(m.n.Hash[:]))
+	return nil
+}
+
+func (m mountNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, res *fuse.ListxattrResponse) error {
+	if m.hashed() {
+		res.Append(HashXattr)
+	}
+	return nil
+}
+
+// hashed tells whether the node carries a meaningful hash
+func (m mountNode) hashed() bool {
+	return !m.n.Mode.IsDir() && !m.n.Failed()
+}
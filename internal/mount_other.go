@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+
+package internal
+
+import "errors"
+
+// HashXattr is the extended attribute holding the hex hash of mounted files
+const HashXattr = "user.hsnap.sha1"
+
+// Mount is not supported on this platform
+func Mount(t *Tree, dir string) error {
+	return errors.New("mount is not supported on this platform")
+}
+
+// Unmount is not supported on this platform
+func Unmount(dir string) error {
+	return errors.New("mount is not supported on this platform")
+}
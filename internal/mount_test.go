@@ -0,0 +1,70 @@
+//go:build linux || darwin || freebsd
+
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestMountNodes(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	rootFS := memfs.New()
+	is.NoErr(rootFS.MkdirAll("d1/album", 0777))
+	is.NoErr(rootFS.WriteFile("d1/album/a.jpg", []byte("aaaa"), 0640))
+
+	FS = rootFS
+	tr := readTree(is, "d1")
+
+	root, err := mountFS{tr}.Root()
+	is.NoErr(err)
+	ds, err := root.(fusefs.HandleReadDirAller).ReadDirAll(ctx)
+	is.NoErr(err)
+	is.Equal(len(ds), 1)
+	is.Equal(ds[0].Name, "album")
+	is.Equal(ds[0].Type, fuse.DT_Dir)
+
+	album, err := root.(fusefs.NodeStringLookuper).Lookup(ctx, "album")
+	is.NoErr(err)
+	for _, name := range []string{"nope", "..", ".", "../album", "a.jpg/.."} {
+		_, err = album.(fusefs.NodeStringLookuper).Lookup(ctx, name)
+		is.Equal(err, fuse.ENOENT) // name
+	}
+	_, err = root.(fusefs.NodeStringLookuper).Lookup(ctx, "album/a.jpg")
+	is.Equal(err, fuse.ENOENT)
+	f, err := album.(fusefs.NodeStringLookuper).Lookup(ctx, "a.jpg")
+	is.NoErr(err)
+
+	// Metadata of the snapshot, no content
+	n := tr.Search("album/a.jpg")
+	var a fuse.Attr
+	is.NoErr(f.Attr(ctx, &a))
+	is.Equal(a.Size, uint64(4))
+	is.Equal(a.Mode, n.Mode)
+	is.True(a.Mtime.Equal(n.ModTime))
+
+	var res fuse.OpenResponse
+	h, err := f.(fusefs.NodeOpener).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &res)
+	is.NoErr(err)
+	is.True(res.Flags&fuse.OpenDirectIO != 0)
+	var rr fuse.ReadResponse
+	is.NoErr(h.(fusefs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 4}, &rr))
+	is.Equal(len(rr.Data), 0)
+	_, err = f.(fusefs.NodeOpener).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &res)
+	is.True(err != nil)
+
+	// Hash as an extended attribute, files only
+	var x fuse.GetxattrResponse
+	is.NoErr(f.(fusefs.NodeGetxattrer).Getxattr(ctx, &fuse.GetxattrRequest{Name: HashXattr}, &x))
+	is.Equal(string(x.Xattr), hex.EncodeToString(n.Hash[:]))
+	err = album.(fusefs.NodeGetxattrer).Getxattr(ctx, &fuse.GetxattrRequest{Name: HashXattr}, &x)
+	is.Equal(err, fuse.ErrNoXattr)
+}
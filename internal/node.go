@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/fs"
 	"sync"
+	"time"
 )
 
 // Node is an entry in the filetree. Either file or directory. A .hsnap file is
@@ -16,10 +17,26 @@ type Node struct {
 	Mode fs.FileMode // Dir ? Link ? etc...
 	Size int64
 
+	// ModTime is zero for nodes of snapshots prior to its introduction
+	ModTime time.Time
+
 	Hash [sha1.Size]byte // hash.Hash // sha1.New()
 
 	ID, ParentID int
 	tree         *Tree
+
+	// Entries WalkFS listed in a directory, see dirHasher
+	entries int
+	listed  bool
+
+	// Err is set when the node could not be listed (directory) or hashed
+	// (file). Such nodes carry no meaningful Hash.
+	Err string
+}
+
+// Failed tells whether an error occurred while snapshotting this node
+func (n *Node) Failed() bool {
+	return n.Err != ""
 }
 
 func (n *Node) Path() string {
@@ -62,5 +79,8 @@ func (n Node) String() string {
 	if n.Mode.IsDir() {
 		d = "d"
 	}
+	if n.Failed() {
+		d = "!"
+	}
 	return fmt.Sprintf("%s%d(%d) %s", d, n.ID, n.ParentID, n.Name)
 }
@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query selects nodes, see ParseQuery
+type Query func(n *Node) bool
+
+// A query reads like the expression of find(1), primaries being combined with
+// -and, which can be left out, -or, ! or -not, and parentheses:
+//
+//	-name '*.jpg' -size +1M -or ( -ext png ! -dup )
+//
+// Primaries take at most one argument.
+var primaries = map[string]func(arg string, p *queryParser) (Query, error){
+	"-name":  globQuery(false),
+	"-iname": globQuery(true),
+	"-regex": regexQuery,
+	"-path":  pathQuery,
+	"-ext":   extQuery,
+	"-size":  sizeQuery,
+	"-newer": timeQuery(true),
+	"-older": timeQuery(false),
+	"-hash":  hashQuery,
+	"-type":  typeQuery,
+	"-dupin": dupInQuery,
+	"-dup":   nil, // takes no argument
+}
+
+// IsQueryToken tells whether arg starts a query
+func IsQueryToken(arg string) bool {
+	if _, ok := primaries[arg]; ok {
+		return true
+	}
+	switch arg {
+	case "(", "!", "-not":
+		return true
+	}
+	return false
+}
+
+// QueryTakesArg tells whether a query token is followed by its argument
+func QueryTakesArg(tok string) bool {
+	return primaries[tok] != nil
+}
+
+// ParseQuery reads a query from command line arguments. load reads the
+// snapshots -dupin refers to. An empty query matches everything.
+func ParseQuery(args []string, load func(path string) (*Tree, error)) (Query, error) {
+	p := &queryParser{args: args, load: load, now: time.Now()}
+	if len(args) == 0 {
+		return func(*Node) bool { return true }, nil
+	}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %s in query", tok)
+	}
+	return q, nil
+}
+
+type queryParser struct {
+	args []string
+	load func(path string) (*Tree, error)
+	now  time.Time
+}
+
+func (p *queryParser) peek() (string, bool) {
+	if len(p.args) == 0 {
+		return "", false
+	}
+	return p.args[0], true
+}
+
+func (p *queryParser) next() (string, bool) {
+	tok, ok := p.peek()
+	if ok {
+		p.args = p.args[1:]
+	}
+	return tok, ok
+}
+
+func (p *queryParser) or() (Query, error) {
+	q, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _ := p.peek(); tok != "-or" && tok != "-o" {
+			return q, nil
+		}
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := q
+		q = func(n *Node) bool { return l(n) || r(n) }
+	}
+}
+
+func (p *queryParser) and() (Query, error) {
+	q, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		switch {
+		case tok == "-and" || tok == "-a":
+			p.next()
+		case !ok || !IsQueryToken(tok):
+			return q, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := q
+		q = func(n *Node) bool { return l(n) && r(n) }
+	}
+}
+
+func (p *queryParser) unary() (Query, error) {
+	tok, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("incomplete query")
+	}
+	switch tok {
+	case "!", "-not":
+		q, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(n *Node) bool { return !q(n) }, nil
+	case "(":
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ := p.next(); tok != ")" {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		return q, nil
+	case "-dup":
+		return dupQuery(), nil
+	}
+	parse, ok := primaries[tok]
+	if !ok {
+		return nil, fmt.Errorf("unknown %s in query", tok)
+	}
+	arg, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("%s needs an argument", tok)
+	}
+	q, err := parse(arg, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tok, err)
+	}
+	return q, nil
+}
+
+func globQuery(fold bool) func(string, *queryParser) (Query, error) {
+	return func(arg string, _ *queryParser) (Query, error) {
+		if fold {
+			arg = strings.ToLower(arg)
+		}
+		if _, err := filepath.Match(arg, ""); err != nil {
+			return nil, err
+		}
+		return func(n *Node) bool {
+			name := n.Name
+			if fold {
+				name = strings.ToLower(name)
+			}
+			ok, _ := filepath.Match(arg, name)
+			return ok
+		}, nil
+	}
+}
+
+// regexQuery matches names against a regular expression, unanchored
+func regexQuery(arg string, _ *queryParser) (Query, error) {
+	re, err := regexp.Compile(arg)
+	if err != nil {
+		return nil, err
+	}
+	return func(n *Node) bool { return re.MatchString(n.Name) }, nil
+}
+
+// pathQuery matches relative paths against a glob, or their prefix for a
+// pattern without meta characters
+func pathQuery(arg string, _ *queryParser) (Query, error) {
+	arg = filepath.Clean("/" + arg)[1:]
+	if _, err := filepath.Match(arg, ""); err != nil {
+		return nil, err
+	}
+	return func(n *Node) bool {
+		path := n.Tree().RelPath(n)
+		if !hasMeta(arg) {
+			return path == arg || strings.HasPrefix(path, arg+string(filepath.Separator))
+		}
+		ok, _ := filepath.Match(arg, path)
+		return ok
+	}, nil
+}
+
+func extQuery(arg string, _ *queryParser) (Query, error) {
+	ext := "." + strings.ToLower(strings.TrimPrefix(arg, "."))
+	return func(n *Node) bool {
+		return !n.Mode.IsDir() && strings.ToLower(filepath.Ext(n.Name)) == ext
+	}, nil
+}
+
+// sizeQuery reads +N for more than N, -N for less than N, MIN..MAX for an
+// inclusive range, or N exactly. Directories have no size.
+func sizeQuery(arg string, _ *queryParser) (Query, error) {
+	var lo, hi int64
+	bounded := true
+	parse := func(s string) (int64, error) {
+		b, err := ParseByteSize(s)
+		return int64(b), err
+	}
+	var err error
+	switch {
+	case strings.HasPrefix(arg, "+"):
+		lo, err = parse(arg[1:])
+		lo++
+		bounded = false
+	case strings.HasPrefix(arg, "-"):
+		hi, err = parse(arg[1:])
+		if err == nil && hi == 0 {
+			return nil, fmt.Errorf("no size is less than %s", arg[1:])
+		}
+		hi--
+	case strings.Contains(arg, ".."):
+		bounds := strings.SplitN(arg, "..", 2)
+		if lo, err = parse(bounds[0]); err == nil {
+			hi, err = parse(bounds[1])
+		}
+	default:
+		lo, err = parse(arg)
+		hi = lo
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(n *Node) bool {
+		return !n.Mode.IsDir() && n.Size >= lo && (!bounded || n.Size <= hi)
+	}, nil
+}
+
+// timeQuery compares modification times to a date, as 2006-01-02 or RFC
+// 3339, or to a duration ago like 12h or 30d. Nodes without a modification
+// time never match.
+func timeQuery(newer bool) func(string, *queryParser) (Query, error) {
+	return func(arg string, p *queryParser) (Query, error) {
+		at, err := parseWhen(arg, p.now)
+		if err != nil {
+			return nil, err
+		}
+		return func(n *Node) bool {
+			if n.ModTime.IsZero() {
+				return false
+			}
+			if newer {
+				return n.ModTime.After(at)
+			}
+			return n.ModTime.Before(at)
+		}, nil
+	}
+}
+
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		d, err := strconv.Atoi(days)
+		if err == nil {
+			return now.AddDate(0, 0, -d), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, use 2006-01-02 or a duration like 30d", s)
+}
+
+func hashQuery(arg string, _ *queryParser) (Query, error) {
+	prefix := strings.ToLower(arg)
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("invalid hash prefix %q", arg)
+	}
+	return func(n *Node) bool {
+		return dupable(n) && strings.HasPrefix(hex.EncodeToString(n.Hash[:]), prefix)
+	}, nil
+}
+
+func typeQuery(arg string, _ *queryParser) (Query, error) {
+	switch arg {
+	case "f":
+		return func(n *Node) bool { return !n.Mode.IsDir() }, nil
+	case "d":
+		return func(n *Node) bool { return n.Mode.IsDir() }, nil
+	}
+	return nil, fmt.Errorf("unknown type %s, use f or d", arg)
+}
+
+// dupQuery matches files having a copy within their own tree
+func dupQuery() Query {
+	groups := make(map[*Tree]HashGroup)
+	return func(n *Node) bool {
+		if !dupable(n) {
+			return false
+		}
+		t := n.Tree()
+		g, ok := groups[t]
+		if !ok {
+			g = make(HashGroup)
+			for _, x := range t.nodes {
+				if dupable(x) {
+					g.Add(x)
+				}
+			}
+			groups[t] = g
+		}
+		return len(g[n.Hash]) > 1
+	}
+}
+
+// dupInQuery matches files having a copy in another snapshot
+func dupInQuery(arg string, p *queryParser) (Query, error) {
+	if p.load == nil {
+		return nil, fmt.Errorf("cannot read %s", arg)
+	}
+	t, err := p.load(arg)
+	if err != nil {
+		return nil, err
+	}
+	g := make(HashGroup)
+	for _, x := range t.nodes {
+		if dupable(x) {
+			g.Add(x)
+		}
+	}
+	return func(n *Node) bool {
+		if !dupable(n) {
+			return false
+		}
+		for _, x := range g[n.Hash] {
+			if x != n {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Find the nodes of t matching q, in path order. The root is left out.
+func (t *Tree) Find(q Query) (ns Nodes) {
+	root := t.Root()
+	paths := make(map[*Node]string)
+	t.Walk(func(path string, n *Node) error {
+		if n != root && q(n) {
+			ns = append(ns, n)
+			paths[n] = pathKey(path)
+		}
+		return nil
+	})
+	sort.Slice(ns, func(i, j int) bool { return paths[ns[i]] < paths[ns[j]] })
+	return
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestQuery(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := newTimedFS()
+
+	is.NoErr(rootFS.MkdirAll("d1/photos/2020", 0777))
+	is.NoErr(rootFS.MkdirAll("d1/docs", 0777))
+	is.NoErr(rootFS.MkdirAll("d2", 0777))
+	is.NoErr(rootFS.WriteFile("d1/photos/2020/a.JPG", []byte("aaaaaaaa"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/photos/b.jpg", []byte("bbbb"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/docs/c.txt", []byte("bbbb"), 0755)) // == b.jpg
+	is.NoErr(rootFS.WriteFile("d1/docs/d.txt", []byte("d"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/e.bin", []byte("aaaaaaaa"), 0755)) // == a.JPG
+
+	FS = rootFS
+	t1, t2 := readTree(is, "d1"), readTree(is, "d2")
+	load := func(string) (*Tree, error) { return t2, nil }
+
+	find := func(args ...string) (ps []string) {
+		q, err := ParseQuery(args, load)
+		is.NoErr(err)
+		for _, n := range t1.Find(q) {
+			ps = append(ps, t1.RelPath(n))
+		}
+		return
+	}
+
+	is.Equal(len(find()), 7)
+	is.Equal(find("-name", "*.jpg"), []string{"photos/b.jpg"})
+	is.Equal(find("-iname", "*.jpg"), []string{"photos/2020/a.JPG", "photos/b.jpg"})
+	is.Equal(find("-ext", "JPG"), []string{"photos/2020/a.JPG", "photos/b.jpg"})
+	is.Equal(find("-regex", `^[cd]\.`), []string{"docs/c.txt", "docs/d.txt"})
+	is.Equal(find("-path", "photos", "-type", "f"), []string{"photos/2020/a.JPG", "photos/b.jpg"})
+	is.Equal(find("-path", "*/*.txt"), []string{"docs/c.txt", "docs/d.txt"})
+	is.Equal(find("-size", "+4"), []string{"photos/2020/a.JPG"})
+	is.Equal(find("-size", "-4"), []string{"docs/d.txt"})
+	is.Equal(find("-size", "2..4"), []string{"docs/c.txt", "photos/b.jpg"})
+	is.Equal(find("-dup"), []string{"docs/c.txt", "photos/b.jpg"})
+	is.Equal(find("-dupin", "d2.hsnap"), []string{"photos/2020/a.JPG"})
+	is.Equal(find("-newer", "1h", "-older", "2099-01-01", "-name", "d.txt"), []string{"docs/d.txt"})
+	is.Equal(len(find("-older", "1h")), 0)
+
+	// and binds tighter than or
+	is.Equal(find("-name", "d.txt", "-or", "-dup", "-ext", "jpg"), []string{"docs/d.txt", "photos/b.jpg"})
+	is.Equal(find("(", "-name", "d.txt", "-or", "-dup", ")", "-ext", "jpg"), []string{"photos/b.jpg"})
+	is.Equal(find("-type", "f", "!", "-ext", "txt", "-and", "-not", "-dup"), []string{"photos/2020/a.JPG"})
+
+	h := t1.Search("docs/d.txt").Hash
+	is.Equal(find("-hash", hex.EncodeToString(h[:3])), []string{"docs/d.txt"})
+
+	is.True(QueryTakesArg("-name"))
+	is.True(!QueryTakesArg("-dup"))
+	is.True(!QueryTakesArg("("))
+
+	for _, bad := range [][]string{
+		{"-size"}, {"(", "-dup"}, {"-dup", ")"}, {"-type", "x"}, {"-size", "1Q"},
+		{"-size", "-0"}, {"-newer", "someday"}, {"-hash", "xyz"}, {"-name", "["},
+		{"-bogus", "1"},
+	} {
+		_, err := ParseQuery(bad, load)
+		is.True(err != nil)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	is := is.New(t)
+	for s, want := range map[string]ByteSize{
+		"512": 512, "10k": 10 * KB, "1.5M": 3 * MB / 2, "2GB": 2 * GB, "3b": 3,
+	} {
+		got, err := ParseByteSize(s)
+		is.NoErr(err)
+		is.Equal(got, want)
+	}
+	_, err := ParseByteSize("-1")
+	is.True(err != nil)
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// A Review lets a user pick, group by group, which copies of duplicated files
+// or directories to delete. Local copies are the deletable ones, they belong
+// to the snapshot of the working directory. Other copies are kept in other
+// snapshots, a group without any keeps at least one of its local copies.
+
+// ErrLastCopy is returned when marking the last kept copy of a group
+var ErrLastCopy = errors.New("last copy, it has to be kept")
+
+// ReviewGroup is a set of identical files, or directories
+type ReviewGroup struct {
+	Dir    bool
+	Stats  DirStats // of a single copy
+	Local  Nodes
+	Others Nodes
+}
+
+// Waste is what deleting every deletable copy would free
+func (g *ReviewGroup) Waste() int64 {
+	n := len(g.Local)
+	if len(g.Others) == 0 {
+		n--
+	}
+	return g.Stats.Bytes * int64(n)
+}
+
+// Match tells whether a copy of the group has s in its path
+func (g *ReviewGroup) Match(s string) bool {
+	for _, ns := range []Nodes{g.Local, g.Others} {
+		for _, n := range ns {
+			if strings.Contains(n.Path(), s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Review of groups, sorted by decreasing waste
+type Review struct {
+	Groups []*ReviewGroup
+	marked map[*Node]bool
+}
+
+// NewReview sorts groups by decreasing waste, leaving out the ones with
+// nothing to delete
+func NewReview(groups []*ReviewGroup) *Review {
+	r := &Review{marked: make(map[*Node]bool)}
+	for _, g := range groups {
+		if g.Waste() > 0 {
+			sort.Slice(g.Local, func(i, j int) bool { return g.Local[i].Path() < g.Local[j].Path() })
+			r.Groups = append(r.Groups, g)
+		}
+	}
+	sort.SliceStable(r.Groups, func(i, j int) bool {
+		a, b := r.Groups[i], r.Groups[j]
+		if a.Waste() != b.Waste() {
+			return a.Waste() > b.Waste()
+		}
+		return a.Local[0].Path() < b.Local[0].Path()
+	})
+	return r
+}
+
+// Marked tells whether n is to be deleted
+func (r *Review) Marked(n *Node) bool {
+	return r.marked[n]
+}
+
+// Mark n for deletion, or unmark it. Only local copies can be marked, and
+// not the last one of a group without other copies.
+func (r *Review) Mark(g *ReviewGroup, n *Node, on bool) error {
+	local := false
+	for _, x := range g.Local {
+		local = local || x == n
+	}
+	switch {
+	case !local:
+		return errors.New("only local copies can be deleted")
+	case !on:
+		delete(r.marked, n)
+		return nil
+	case !r.marked[n] && len(g.Others) == 0 && r.kept(g) == 1:
+		return ErrLastCopy
+	}
+	r.marked[n] = true
+	return nil
+}
+
+// MarkGroup marks every deletable copy of g, keeping the first local one in a
+// group without other copies, or unmarks them all
+func (r *Review) MarkGroup(g *ReviewGroup, on bool) {
+	for i, n := range g.Local {
+		if on && i == 0 && len(g.Others) == 0 {
+			delete(r.marked, n)
+			continue
+		}
+		r.Mark(g, n, on)
+	}
+}
+
+// kept counts the local copies of g that are not marked
+func (r *Review) kept(g *ReviewGroup) (c int) {
+	for _, n := range g.Local {
+		if !r.marked[n] {
+			c++
+		}
+	}
+	return
+}
+
+// Plan lists the marked directories and files, in group order, along with
+// the bytes and files deleting them frees
+func (r *Review) Plan() (dirs, files Nodes, freed DirStats) {
+	for _, g := range r.Groups {
+		for _, n := range g.Local {
+			if !r.marked[n] {
+				continue
+			}
+			if g.Dir {
+				dirs = append(dirs, n)
+			} else {
+				files = append(files, n)
+			}
+			freed.Files += g.Stats.Files
+			freed.Bytes += g.Stats.Bytes
+		}
+	}
+	return
+}
+
+// TrimReview groups the copies of t found in withs, as trim reports them:
+// directories found elsewhere, then files outside of these
+func TrimReview(t *Tree, withs ...*Tree) *Review {
+	var groups []*ReviewGroup
+	var dirs Nodes
+	for _, dm := range t.TrimDirs(withs...) {
+		groups = append(groups, &ReviewGroup{Dir: true, Stats: t.DirStats(dm.Dir), Local: Nodes{dm.Dir}, Others: dm.Others})
+		dirs = append(dirs, dm.Dir)
+	}
+	inDirs := Below(dirs)
+
+	matches := t.Trim(withs...)
+	matches.PruneSingleTreeGroups()
+	for _, ma := range matches {
+		in, out := SplitNodes(t, ma)
+		if g := fileGroup(in, out, inDirs); g != nil {
+			groups = append(groups, g)
+		}
+	}
+	return NewReview(groups)
+}
+
+// DupReview groups the copies of duplicated directories and files of local,
+// as dup reports them, trees holding other copies
+func DupReview(local *Tree, trees ...*Tree) *Review {
+	var groups []*ReviewGroup
+	var dirs Nodes
+	for _, dg := range DupDirs(append([]*Tree{local}, trees...)...) {
+		in, out := SplitNodes(local, dg)
+		if len(in) == 0 {
+			continue
+		}
+		groups = append(groups, &ReviewGroup{Dir: true, Stats: local.DirStats(in[0]), Local: in, Others: out})
+		dirs = append(dirs, in...)
+	}
+	inDirs := Below(dirs)
+
+	matches := make(HashGroup)
+	for _, t := range append([]*Tree{local}, trees...) {
+		for _, n := range t.nodes {
+			matches.Add(n)
+		}
+	}
+	for _, ma := range matches {
+		in, out := SplitNodes(local, ma)
+		if g := fileGroup(in, out, inDirs); g != nil {
+			groups = append(groups, g)
+		}
+	}
+	return NewReview(groups)
+}
+
+// fileGroup of local copies in, but the ones below dirs that are reviewed as
+// a whole, and other copies out
+func fileGroup(in, out Nodes, dirs map[*Node]bool) *ReviewGroup {
+	var local Nodes
+	for _, n := range in {
+		if !dirs[n] {
+			local = append(local, n)
+		}
+	}
+	if len(local) == 0 || local[0].Size == 0 {
+		return nil
+	}
+	return &ReviewGroup{Stats: DirStats{Files: 1, Bytes: local[0].Size}, Local: local, Others: out}
+}
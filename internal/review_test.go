@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestReview(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	for _, d := range []string{"d1/album", "d1/copy", "d2/album"} {
+		is.NoErr(rootFS.MkdirAll(d, 0777))
+		is.NoErr(rootFS.WriteFile(d+"/a.jpg", []byte("aaaa"), 0755))
+		is.NoErr(rootFS.WriteFile(d+"/b.jpg", []byte("bbbb"), 0755))
+	}
+	is.NoErr(rootFS.WriteFile("d1/big.bin", []byte("cccccccccc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/big2.bin", []byte("cccccccccc"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/big.bin", []byte("cccccccccc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/only.bin", []byte("dd"), 0755))
+
+	FS = rootFS
+	t1, t2 := readTree(is, "d1"), readTree(is, "d2")
+
+	// Against d2, both local albums and big files can go, sorted by waste
+	r := TrimReview(t1, t2)
+	is.Equal(len(r.Groups), 3)
+	is.Equal(r.Groups[0].Waste(), int64(20))
+	is.Equal(r.Groups[0].Local, Nodes{t1.Search("big.bin"), t1.Search("big2.bin")})
+	is.True(r.Groups[1].Dir)
+	is.Equal(r.Groups[1].Others, Nodes{t2.Search("album")})
+	is.True(r.Groups[2].Match("copy"))
+
+	r.MarkGroup(r.Groups[0], true)
+	is.NoErr(r.Mark(r.Groups[1], t1.Search("album"), true))
+	is.True(r.Mark(r.Groups[1], t2.Search("album"), true) != nil) // remote
+	dirs, files, freed := r.Plan()
+	is.Equal(dirs, Nodes{t1.Search("album")})
+	is.Equal(len(files), 2)
+	is.Equal(freed, DirStats{Files: 4, Bytes: 28})
+
+	// Alone, a copy of each group is kept
+	r = DupReview(t1)
+	is.Equal(len(r.Groups), 2)
+	is.Equal(r.Groups[0].Waste(), int64(10))
+	g := r.Groups[0]
+	is.NoErr(r.Mark(g, g.Local[0], true))
+	is.Equal(r.Mark(g, g.Local[1], true), ErrLastCopy)
+	is.NoErr(r.Mark(g, g.Local[0], false))
+	is.NoErr(r.Mark(g, g.Local[1], true))
+	g = r.Groups[1]
+	is.True(g.Dir)
+	r.MarkGroup(g, true)
+	is.True(!r.Marked(g.Local[0]))
+	is.True(r.Marked(g.Local[1]))
+	_, _, freed = r.Plan()
+	is.Equal(freed, DirStats{Files: 3, Bytes: 18})
+
+	// With d2, the local album files are reviewed within their directory
+	r = DupReview(t1, t2)
+	is.Equal(len(r.Groups), 2)
+	is.Equal(len(r.Groups[1].Local), 2)
+	is.Equal(r.Groups[1].Others, Nodes{t2.Search("album")})
+	is.Equal(r.Groups[0].Others, Nodes{t2.Search("big.bin")})
+}
@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server browses snapshots over HTTP, read-only, as a small web UI and a JSON
+// API under /api. Trees are read once and shared by concurrent requests,
+// which never write to them.
+//
+//	GET /api/snapshots                  loaded snapshots
+//	GET /api/snapshots/{id}             info and footer of a snapshot
+//	GET /api/snapshots/{id}/ls?path=    content of a directory, sort=size|time
+//	GET /api/find?q=QUERY&in={id}       nodes matching a query, see ParseQuery
+//	GET /api/trim?snap={id}&with={id}   copies of a snapshot found in others
+//	GET /api/dup?snap={id}&with={id}    duplicates of a snapshot
+//
+// in and with can be repeated, and default to every other snapshot.
+type Server struct {
+	Trees []*Tree
+	// Limit on the nodes or groups listed by a response
+	Limit int
+
+	ids map[*Tree]int
+	mux *http.ServeMux
+}
+
+// NewServer serves trees, named by their position
+func NewServer(trees ...*Tree) *Server {
+	s := &Server{Trees: trees, Limit: 1000, ids: make(map[*Tree]int), mux: http.NewServeMux()}
+	for i, t := range trees {
+		s.ids[t] = i
+	}
+	s.mux.HandleFunc("GET /api/snapshots", s.apiSnapshots)
+	s.mux.HandleFunc("GET /api/snapshots/{id}", s.apiSnapshot)
+	s.mux.HandleFunc("GET /api/snapshots/{id}/ls", s.apiList)
+	s.mux.HandleFunc("GET /api/find", s.apiFind)
+	s.mux.HandleFunc("GET /api/trim", s.apiReview(false))
+	s.mux.HandleFunc("GET /api/dup", s.apiReview(true))
+	s.mux.HandleFunc("GET /{$}", s.page("index", s.apiSnapshotsData))
+	s.mux.HandleFunc("GET /snapshots/{id}/", s.page("snapshot", s.snapshotPageData))
+	s.mux.HandleFunc("GET /find", s.page("find", s.findData))
+	s.mux.HandleFunc("GET /trim", s.page("review", s.reviewData(false)))
+	s.mux.HandleFunc("GET /dup", s.page("review", s.reviewData(true)))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// errBadRequest wraps errors caused by the request itself, errNotFound the
+// ones about missing paths
+var (
+	errBadRequest = errors.New("bad request")
+	errNotFound   = errors.New("not found")
+)
+
+func badRequest(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errBadRequest, fmt.Sprintf(format, args...))
+}
+
+// SnapshotJSON describes a loaded snapshot
+type SnapshotJSON struct {
+	ID        int     `json:"id"`
+	Label     string  `json:"label"`
+	Integrity string  `json:"integrity"`
+	Info      *Info   `json:"info"`
+	Footer    *Footer `json:"footer,omitempty"`
+}
+
+// NodeJSON describes a node, directories being sized after their content
+type NodeJSON struct {
+	Snapshot int        `json:"snapshot"`
+	Path     string     `json:"path"`
+	Name     string     `json:"name"`
+	Dir      bool       `json:"dir,omitempty"`
+	Size     int64      `json:"size"`
+	Files    int64      `json:"files,omitempty"`
+	ModTime  *time.Time `json:"mtime,omitempty"`
+	Hash     string     `json:"hash,omitempty"`
+	Err      string     `json:"error,omitempty"`
+}
+
+// ListJSON is the content of a directory
+type ListJSON struct {
+	Dir     NodeJSON   `json:"dir"`
+	Entries []NodeJSON `json:"entries"`
+}
+
+// FindJSON lists the matches of a query
+type FindJSON struct {
+	Query     string     `json:"query"`
+	Nodes     []NodeJSON `json:"nodes"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// GroupJSON is a group of copies, see ReviewGroup
+type GroupJSON struct {
+	Dir    bool       `json:"dir,omitempty"`
+	Files  int64      `json:"files"`
+	Bytes  int64      `json:"bytes"`
+	Waste  int64      `json:"waste"`
+	Local  []NodeJSON `json:"local"`
+	Others []NodeJSON `json:"others"`
+}
+
+// ReviewJSON lists the groups of a trim or dup
+type ReviewJSON struct {
+	Snapshot  int         `json:"snapshot"`
+	With      []int       `json:"with"`
+	Waste     int64       `json:"waste"`
+	Groups    []GroupJSON `json:"groups"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+func (s *Server) snapshotJSON(t *Tree) SnapshotJSON {
+	label := t.Name
+	if label == "" {
+		label = t.Info.String()
+	}
+	return SnapshotJSON{ID: s.ids[t], Label: label, Integrity: t.Integrity.String(), Info: t.Info, Footer: t.Footer}
+}
+
+func (s *Server) nodeJSON(n *Node, st DirStats) NodeJSON {
+	t := n.Tree()
+	j := NodeJSON{Snapshot: s.ids[t], Path: t.RelPath(n), Name: n.Name, Dir: n.Mode.IsDir(), Size: n.Size, Err: n.Err}
+	if j.Dir {
+		j.Size, j.Files = st.Bytes, st.Files
+	} else if !n.Failed() {
+		j.Hash = hex.EncodeToString(n.Hash[:])
+	}
+	if !n.ModTime.IsZero() {
+		j.ModTime = &n.ModTime
+	}
+	return j
+}
+
+// tree of an id
+func (s *Server) tree(v string) (*Tree, error) {
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 0 || id >= len(s.Trees) {
+		return nil, badRequest("unknown snapshot %q", v)
+	}
+	return s.Trees[id], nil
+}
+
+// trees of a repeated query parameter, all but except when missing
+func (s *Server) trees(r *http.Request, key string, except *Tree) (ts []*Tree, err error) {
+	vs := r.URL.Query()[key]
+	if len(vs) == 0 {
+		for _, t := range s.Trees {
+			if t != except {
+				ts = append(ts, t)
+			}
+		}
+		return
+	}
+	for _, v := range vs {
+		t, err := s.tree(v)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return
+}
+
+// writeJSON writes data, or err
+func writeJSON(w http.ResponseWriter, data any, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(statusOf(err))
+		data = map[string]string{"error": err.Error()}
+	}
+	json.NewEncoder(w).Encode(data)
+}
+
+// statusOf an error, telling whose fault it is
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) apiSnapshotsData(*http.Request) (any, error) {
+	ss := []SnapshotJSON{}
+	for _, t := range s.Trees {
+		ss = append(ss, s.snapshotJSON(t))
+	}
+	return ss, nil
+}
+
+func (s *Server) apiSnapshots(w http.ResponseWriter, r *http.Request) {
+	data, err := s.apiSnapshotsData(r)
+	writeJSON(w, data, err)
+}
+
+func (s *Server) apiSnapshot(w http.ResponseWriter, r *http.Request) {
+	t, err := s.tree(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	writeJSON(w, s.snapshotJSON(t), nil)
+}
+
+func (s *Server) list(r *http.Request) (*ListJSON, error) {
+	t, err := s.tree(r.PathValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	by := ListOrder(r.URL.Query().Get("sort"))
+	switch by {
+	case "":
+		by = ByName
+	case ByName, BySize, ByTime:
+	default:
+		return nil, badRequest("unknown sort %q", by)
+	}
+	path := r.URL.Query().Get("path")
+	n := t.Search(path)
+	if n == nil {
+		return nil, fmt.Errorf("%w: %s", errNotFound, path)
+	}
+
+	var es []Entry
+	for _, c := range t.ChildrenOf(n) {
+		es = append(es, Entry{NodeP: NodeP{Node: c}, Stats: t.DirStats(c)})
+	}
+	SortListing(es, by)
+	l := &ListJSON{Dir: s.nodeJSON(n, t.DirStats(n)), Entries: []NodeJSON{}}
+	for _, e := range es {
+		l.Entries = append(l.Entries, s.nodeJSON(e.Node, e.Stats))
+	}
+	return l, nil
+}
+
+func (s *Server) apiList(w http.ResponseWriter, r *http.Request) {
+	l, err := s.list(r)
+	writeJSON(w, l, err)
+}
+
+// find runs the q query over the in snapshots. The query is split on spaces,
+// -dupin refers to snapshots by id.
+func (s *Server) find(r *http.Request) (*FindJSON, error) {
+	ts, err := s.trees(r, "in", nil)
+	if err != nil {
+		return nil, err
+	}
+	f := &FindJSON{Query: r.URL.Query().Get("q"), Nodes: []NodeJSON{}}
+	q, err := ParseQuery(strings.Fields(f.Query), func(id string) (*Tree, error) {
+		return s.tree(id)
+	})
+	if err != nil {
+		return nil, badRequest("%s", err)
+	}
+	for _, t := range ts {
+		for _, n := range t.Find(q) {
+			if len(f.Nodes) == s.Limit {
+				f.Truncated = true
+				return f, nil
+			}
+			f.Nodes = append(f.Nodes, s.nodeJSON(n, t.DirStats(n)))
+		}
+	}
+	return f, nil
+}
+
+func (s *Server) apiFind(w http.ResponseWriter, r *http.Request) {
+	f, err := s.find(r)
+	writeJSON(w, f, err)
+}
+
+// review groups the copies of snap, in the with snapshots, as trim or dup do
+func (s *Server) review(r *http.Request, dup bool) (*ReviewJSON, error) {
+	t, err := s.tree(r.URL.Query().Get("snap"))
+	if err != nil {
+		return nil, err
+	}
+	withs, err := s.trees(r, "with", t)
+	if err != nil {
+		return nil, err
+	}
+	rj := &ReviewJSON{Snapshot: s.ids[t], With: []int{}, Groups: []GroupJSON{}}
+	for _, x := range withs {
+		if x == t || t.Overlaps(x) {
+			return nil, badRequest("snapshot %d overlaps with %d", s.ids[x], s.ids[t])
+		}
+		rj.With = append(rj.With, s.ids[x])
+	}
+
+	var rv *Review
+	if dup {
+		rv = DupReview(t, withs...)
+	} else if len(withs) > 0 {
+		rv = TrimReview(t, withs...)
+	} else {
+		rv = NewReview(nil)
+	}
+	for _, g := range rv.Groups {
+		rj.Waste += g.Waste()
+		if len(rj.Groups) == s.Limit {
+			rj.Truncated = true
+			continue
+		}
+		gj := GroupJSON{Dir: g.Dir, Files: g.Stats.Files, Bytes: g.Stats.Bytes, Waste: g.Waste()}
+		for _, n := range g.Local {
+			gj.Local = append(gj.Local, s.nodeJSON(n, g.Stats))
+		}
+		gj.Others = []NodeJSON{}
+		for _, n := range g.Others {
+			gj.Others = append(gj.Others, s.nodeJSON(n, g.Stats))
+		}
+		rj.Groups = append(rj.Groups, gj)
+	}
+	return rj, nil
+}
+
+func (s *Server) apiReview(dup bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rj, err := s.review(r, dup)
+		writeJSON(w, rj, err)
+	}
+}
+
+//go:embed serve.html
+var pagesFS embed.FS
+
+var pages = template.Must(template.New("").Funcs(template.FuncMap{
+	"size": func(b int64) string { return ByteSize(b).String() },
+	"join": filepath.Join,
+	"dir":  filepath.Dir,
+}).ParseFS(pagesFS, "serve.html"))
+
+// page renders the template name with what data returns, along with the
+// loaded snapshots
+func (s *Server) page(name string, data func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, err := data(r)
+		if err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+			return
+		}
+		snaps, _ := s.apiSnapshotsData(r)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		pages.ExecuteTemplate(w, name, map[string]any{
+			"Snapshots": snaps,
+			"Data":      d,
+			"Query":     r.URL.Query(),
+		})
+	}
+}
+
+func (s *Server) snapshotPageData(r *http.Request) (any, error) {
+	t, err := s.tree(r.PathValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	l, err := s.list(r)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"Snapshot": s.snapshotJSON(t), "List": l}, nil
+}
+
+func (s *Server) findData(r *http.Request) (any, error) {
+	if r.URL.Query().Get("q") == "" {
+		return nil, nil
+	}
+	return s.find(r)
+}
+
+func (s *Server) reviewData(dup bool) func(*http.Request) (any, error) {
+	return func(r *http.Request) (any, error) {
+		if r.URL.Query().Get("snap") == "" {
+			return map[string]any{"Dup": dup}, nil
+		}
+		rj, err := s.review(r, dup)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"Dup": dup, "Review": rj}, nil
+	}
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestServer(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	for _, d := range []string{"d1/album", "d2/album"} {
+		is.NoErr(rootFS.MkdirAll(d, 0777))
+		is.NoErr(rootFS.WriteFile(d+"/a.jpg", []byte("aaaa"), 0755))
+		is.NoErr(rootFS.WriteFile(d+"/b.jpg", []byte("bbbb"), 0755))
+	}
+	is.NoErr(rootFS.WriteFile("d1/big.bin", []byte("cccccccccc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/big2.bin", []byte("cccccccccc"), 0755))
+
+	FS = rootFS
+	t1, t2 := readTree(is, "d1"), readTree(is, "d2")
+
+	ts := httptest.NewServer(NewServer(t1, t2))
+	defer ts.Close()
+
+	get := func(path string, v any) int {
+		res, err := http.Get(ts.URL + path)
+		is.NoErr(err)
+		defer res.Body.Close()
+		if v != nil {
+			is.NoErr(json.NewDecoder(res.Body).Decode(v))
+		}
+		return res.StatusCode
+	}
+
+	var snaps []SnapshotJSON
+	is.Equal(get("/api/snapshots", &snaps), 200)
+	is.Equal(len(snaps), 2)
+	is.Equal(snaps[1].ID, 1)
+	is.Equal(snaps[0].Integrity, "complete")
+	is.Equal(snaps[0].Info.Nonce, t1.Info.Nonce)
+
+	var l ListJSON
+	is.Equal(get("/api/snapshots/0/ls?sort=size", &l), 200)
+	is.Equal(l.Dir.Files, int64(4))
+	is.Equal(len(l.Entries), 3)
+	is.Equal(l.Entries[0].Name, "album")
+	is.Equal(l.Entries[0].Size, int64(8))
+	is.Equal(l.Entries[1].Name, "big.bin")
+	is.Equal(get("/api/snapshots/0/ls?path=album", &l), 200)
+	is.Equal(l.Entries[0].Path, "album/a.jpg")
+	is.Equal(get("/api/snapshots/0/ls?path=nope", nil), 404)
+	is.Equal(get("/api/snapshots/7/ls", nil), 400)
+
+	var f FindJSON
+	is.Equal(get("/api/find?q="+url.QueryEscape("-name a.jpg"), &f), 200)
+	is.Equal(len(f.Nodes), 2)
+	is.Equal(f.Nodes[1].Snapshot, 1)
+	is.Equal(get("/api/find?in=0&q="+url.QueryEscape("-ext bin -dupin 1 -or -dup"), &f), 200)
+	is.Equal(len(f.Nodes), 2)
+	is.Equal(f.Nodes[0].Path, "big.bin")
+	is.Equal(get("/api/find?q=-bogus", nil), 400)
+
+	var rv ReviewJSON
+	is.Equal(get("/api/trim?snap=0", &rv), 200)
+	is.Equal(rv.With, []int{1})
+	is.Equal(len(rv.Groups), 1)
+	is.True(rv.Groups[0].Dir)
+	is.Equal(rv.Groups[0].Others[0].Snapshot, 1)
+	is.Equal(get("/api/dup?snap=0", &rv), 200)
+	is.Equal(rv.Waste, int64(10+8))
+	is.Equal(get("/api/trim?snap=0&with=0", nil), 400)
+
+	// Pages render, and requests can run concurrently
+	var wg sync.WaitGroup
+	for _, p := range []string{"/", "/snapshots/0/?path=album", "/find?q=-dup", "/trim?snap=0", "/dup", "/snapshots/1/"} {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			res, err := http.Get(ts.URL + p)
+			is.NoErr(err)
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			is.Equal(res.StatusCode, 200)
+			is.True(strings.Contains(string(b), "</html>"))
+		}(p)
+	}
+	wg.Wait()
+
+	// Read-only
+	res, err := http.Post(ts.URL+"/api/snapshots", "application/json", nil)
+	is.NoErr(err)
+	res.Body.Close()
+	is.Equal(res.StatusCode, http.StatusMethodNotAllowed)
+}
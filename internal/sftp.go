@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"io/fs"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTP filesystem of a remote host, so that hosts hsnap cannot run on get
+// snapshotted from here, file contents being streamed over to be hashed. As
+// with OS, paths are the ones of the remote host. Set it as FS before
+// snapshotting.
+type SFTP struct {
+	c *sftp.Client
+}
+
+// NewSFTP filesystem over an established SFTP session
+func NewSFTP(c *sftp.Client) *SFTP {
+	return &SFTP{c}
+}
+
+func (s *SFTP) Open(name string) (fs.File, error) {
+	f, err := s.c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *SFTP) Stat(name string) (os.FileInfo, error) {
+	return s.c.Stat(name)
+}
+
+func (s *SFTP) ReadDir(name string) ([]os.DirEntry, error) {
+	infos, err := s.c.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	ds := make([]os.DirEntry, len(infos))
+	for i, info := range infos {
+		ds[i] = fs.FileInfoToDirEntry(info)
+	}
+	return ds, nil
+}
+
+// Close the SFTP session
+func (s *SFTP) Close() error {
+	return s.c.Close()
+}
+
+var _ fs.StatFS = &SFTP{}
+var _ fs.ReadDirFS = &SFTP{}
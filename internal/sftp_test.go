@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/pkg/sftp"
+)
+
+// sftpPipe connects a client to an in-process read-only SFTP server
+func sftpPipe(is *is.I) *sftp.Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	srv, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, sftp.ReadOnly())
+	is.NoErr(err)
+	go func() {
+		srv.Serve()
+		srv.Close()
+	}()
+
+	c, err := sftp.NewClientPipe(cr, cw)
+	is.NoErr(err)
+	return c
+}
+
+func TestSFTP(t *testing.T) {
+	is := is.New(t)
+
+	root := t.TempDir()
+	is.NoErr(os.MkdirAll(filepath.Join(root, "album"), 0777))
+	is.NoErr(os.WriteFile(filepath.Join(root, "album/a.jpg"), []byte("aaaa"), 0644))
+	is.NoErr(os.WriteFile(filepath.Join(root, "b.jpg"), []byte("bbbb"), 0644))
+	is.NoErr(os.WriteFile(filepath.Join(root, "empty"), nil, 0644))
+
+	remote := NewSFTP(sftpPipe(is))
+	defer remote.Close()
+
+	FS = remote
+	defer func() { FS = OS{} }()
+
+	r, w := io.Pipe()
+	go func() {
+		Snapshot(root, w, io.Discard, SnapshotOptions{Hostname: "nas"})
+		w.Close()
+	}()
+	tr, err := ReadTree(r)
+	is.NoErr(err)
+
+	is.Equal(tr.Info.Hostname, "nas")
+	is.Equal(tr.Info.RootPath, root)
+	is.Equal(len(tr.nodes), 4) // empty is left out
+	a := tr.Search("album/a.jpg")
+	is.True(a != nil)
+	is.Equal(a.Size, int64(4))
+	is.Equal(a.Hash, sha1.Sum([]byte("aaaa")))
+	is.True(tr.Search("album").Mode.IsDir())
+	is.Equal(tr.Search("b.jpg").Hash, sha1.Sum([]byte("bbbb")))
+
+	_, err = remote.Stat(filepath.Join(root, "nope"))
+	is.True(os.IsNotExist(err))
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+// Snapshots carry a sha256 Checksum of their uncompressed stream up to the
+// footer (Info, nodes, end marker and directory hashes). A signed snapshot also has an ed25519
+// signature of that checksum in its footer, along with the signer public
+// key. Footer statistics are informative and left out of the signature.
+
+const (
+	verifyKeyPrefix  = "hsnapsig1"
+	signingKeyPrefix = "HSNAP-SIGNING-KEY-"
+	signatureContext = "hsnap signature v1\n"
+)
+
+var (
+	// ErrChecksum is returned when a snapshot does not match its checksum
+	ErrChecksum = errors.New("snapshot checksum mismatch, file is corrupt or tampered")
+	// ErrUnsigned is returned when verifying a snapshot without signature
+	ErrUnsigned = errors.New("snapshot is not signed")
+	// ErrUntrusted is returned for a valid signature from an unknown key
+	ErrUntrusted = errors.New("snapshot is signed by an untrusted key")
+	// ErrBadSignature is returned when the signature does not match
+	ErrBadSignature = errors.New("snapshot signature is invalid")
+)
+
+// TrustedKey is a signer public key, named after the comment following it in
+// the trusted keys file
+type TrustedKey struct {
+	Key  ed25519.PublicKey
+	Name string
+}
+
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, err
+}
+
+// FormatSigningKey encodes a private key as HSNAP-SIGNING-KEY-...
+func FormatSigningKey(k ed25519.PrivateKey) string {
+	return signingKeyPrefix + base64.RawURLEncoding.EncodeToString(k.Seed())
+}
+
+// FormatVerifyKey encodes a public key as hsnapsig1...
+func FormatVerifyKey(k ed25519.PublicKey) string {
+	return verifyKeyPrefix + base64.RawURLEncoding.EncodeToString(k)
+}
+
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	raw, err := decodeKey(s, signingKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.SeedSize {
+		return nil, errors.New("malformed signing key")
+	}
+	return ed25519.NewKeyFromSeed(raw), nil
+}
+
+func ParseVerifyKey(s string) (ed25519.PublicKey, error) {
+	raw, err := decodeKey(s, verifyKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// ReadSigningKeyFile reads the first signing key of a file, skipping #
+// comments.
+func ReadSigningKeyFile(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, signingKeyPrefix) {
+			return ParseSigningKey(line)
+		}
+	}
+	return nil, fmt.Errorf("no signing key found in %s", path)
+}
+
+// ReadTrustedKeys reads a file of public keys, one per line, optionally
+// followed by a name. Blank lines and # comments are skipped.
+func ReadTrustedKeys(path string) (ts []TrustedKey, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		k, err := ParseVerifyKey(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, TrustedKey{k, strings.Join(fields[1:], " ")})
+	}
+	return ts, sc.Err()
+}
+
+func signedMessage(checksum []byte) []byte {
+	return append([]byte(signatureContext), checksum...)
+}
+
+// sign the footer checksum
+func (f *Footer) sign(k ed25519.PrivateKey) {
+	f.SignerKey = k.Public().(ed25519.PublicKey)
+	f.Signature = ed25519.Sign(k, signedMessage(f.Checksum))
+}
+
+// Signed tells whether the footer holds a signature, valid or not
+func (f *Footer) Signed() bool {
+	return f != nil && len(f.Signature) > 0
+}
+
+// Verify the footer signature against trusted keys, returning the matching
+// one. The checksum itself is verified while reading, see ReadTree.
+func (f *Footer) Verify(trusted []TrustedKey) (*TrustedKey, error) {
+	if !f.Signed() {
+		return nil, ErrUnsigned
+	}
+	if len(f.SignerKey) != ed25519.PublicKeySize || !ed25519.Verify(f.SignerKey, signedMessage(f.Checksum), f.Signature) {
+		return nil, ErrBadSignature
+	}
+	for i := range trusted {
+		if bytes.Equal(trusted[i].Key, f.SignerKey) {
+			return &trusted[i], nil
+		}
+	}
+	return nil, ErrUntrusted
+}
+
+// hashingReader feeds a hash with the bytes read through it. It is a
+// ByteReader so that gob does not buffer, and reads ahead, past what it
+// decodes.
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+
+func (hr *hashingReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.h.Write([]byte{b})
+	}
+	return b, err
+}
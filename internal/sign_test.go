@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestSignedSnapshot(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+	is.NoErr(rootFS.MkdirAll("d1", 0777))
+	is.NoErr(rootFS.WriteFile("d1/f1.txt", []byte("abc"), 0755))
+	FS = rootFS
+
+	k, err := GenerateSigningKey()
+	is.NoErr(err)
+	pub, err := ParseVerifyKey(FormatVerifyKey(k.Public().(ed25519.PublicKey)))
+	is.NoErr(err)
+	other, err := GenerateSigningKey()
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	Snapshot("d1", &buf, io.Discard, SnapshotOptions{Signer: k})
+	data := buf.Bytes()
+
+	tr, err := ReadTree(bytes.NewReader(data))
+	is.NoErr(err)
+	tk, err := tr.Footer.Verify([]TrustedKey{{other.Public().(ed25519.PublicKey), "other"}, {pub, "me"}})
+	is.NoErr(err)
+	is.Equal(tk.Name, "me")
+
+	_, err = tr.Footer.Verify([]TrustedKey{{other.Public().(ed25519.PublicKey), "other"}})
+	is.Equal(err, ErrUntrusted)
+
+	tr.Footer.Checksum[0] ^= 1
+	_, err = tr.Footer.Verify([]TrustedKey{{pub, "me"}})
+	is.Equal(err, ErrBadSignature)
+
+	// Renaming a file breaks the checksum
+	tampered := bytes.Replace(data, []byte("f1.txt"), []byte("f2.txt"), 1)
+	_, err = ReadTree(bytes.NewReader(tampered))
+	is.Equal(err, ErrChecksum)
+
+	// Unsigned snapshots still carry a checksum
+	buf.Reset()
+	Snapshot("d1", &buf, io.Discard, SnapshotOptions{})
+	tr, err = ReadTree(&buf)
+	is.NoErr(err)
+	is.True(tr.Footer.Checksum != nil)
+	_, err = tr.Footer.Verify([]TrustedKey{{pub, "me"}})
+	is.Equal(err, ErrUnsigned)
+}
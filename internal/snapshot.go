@@ -2,22 +2,27 @@ package internal
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/gob"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 const STATE_NAME = ".hsnap"
-const VERSION = 1
+const VERSION = 3
 
 // Skipper indicate a Node should be skipped by returning true
 type Skipper func(fs.FileInfo) bool
@@ -27,10 +32,20 @@ var DefaultSkipper = func(fs.FileInfo) bool {
 	return false
 }
 
+// WalkConcurrency bounds how many directories WalkFS lists at the same time.
+// Listing is mostly waiting on the filesystem (think NFS or SMB mounts), so
+// it is worth going above the CPU count.
+var WalkConcurrency = 4 * runtime.NumCPU()
+
 // WalkFS walks a filetree in a breadth first manner
 // It generates a stream of *Nodes to be used.
 // Once the walker has explored all files, it closes the emitting channel.
 // Each node receives a unique increment id, starting at 1.
+//
+// Directories are listed concurrently by up to WalkConcurrency workers, but
+// nodes are still emitted in BFS order, a parent always before its children.
+// Entries of a directory are sorted by name before receiving their id, so
+// walking the same filetree twice yields the same ids.
 func WalkFS(ctx context.Context, skip Skipper, root string) <-chan NodeP {
 	lstat := FS.(fs.StatFS).Stat
 
@@ -50,57 +65,160 @@ func WalkFS(ctx context.Context, skip Skipper, root string) <-chan NodeP {
 		}
 
 		rootNode := &Node{
-			ID:   Reset(),
-			Mode: info.Mode(),
-			Name: info.Name(),
-			Size: info.Size(),
+			ID:      Reset(),
+			Mode:    info.Mode(),
+			Name:    info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		workers := WalkConcurrency
+		if workers < 1 {
+			workers = 1
+		}
+		jobs := make(chan *listing, workers)
+		defer close(jobs)
+		for w := 0; w < workers; w++ {
+			go func() {
+				for l := range jobs {
+					l.list(skip)
+				}
+			}()
+		}
+
+		// Every queued directory has its listing scheduled as soon as it is
+		// queued, so that workers keep ahead of the emitting loop below.
+		enqueue := func(q []walkItem, np NodeP) []walkItem {
+			it := walkItem{np: np}
+			if np.Node.Mode.IsDir() {
+				it.l = &listing{path: np.Path, done: make(chan struct{})}
+				select {
+				case jobs <- it.l:
+				case <-ctx.Done():
+				}
+			}
+			return append(q, it)
 		}
 
-		q := []NodeP{{
-			rootNode, root,
-		}}
-		var np NodeP
+		q := enqueue(nil, NodeP{Node: rootNode, Path: root})
+		var it walkItem
 
 		// Actual BFS
 		for len(q) > 0 {
 			// Shift first node
-			np, q = q[0], q[1:]
+			it, q = q[0], q[1:]
 
 			// Walk deeper in directory
-			if np.Node.Mode.IsDir() {
-				names, err := readDirNames(np.Path)
-				if err != nil {
-					log.Printf("Listing directory %s failed: %s", np.Path, err)
-					continue
+			if it.l != nil {
+				select {
+				case <-it.l.done:
+				case <-ctx.Done():
+					return
 				}
-				for _, name := range names {
-					cpath := filepath.Join(np.Path, name.Name())
-					info, err := lstat(cpath)
-					if err != nil {
-						log.Printf("Node creation failed: %s", err)
-					}
-					if skip != nil && skip(info) {
-						continue
-					}
+				if it.l.err != nil {
+					// Keep the directory, so that its subtree shows up as
+					// unreadable rather than missing
+					it.np.Node.Err = it.l.err.Error()
+				}
+				it.np.Node.entries, it.np.Node.listed = len(it.l.entries), true
+				for _, e := range it.l.entries {
 					child := &Node{
 						ID:       Allocate(),
-						ParentID: np.Node.ID,
-						Mode:     info.Mode(),
-						Name:     info.Name(),
-						Size:     info.Size(),
+						ParentID: it.np.Node.ID,
+						Name:     e.name,
+						Mode:     e.mode,
+						Size:     e.size,
+						ModTime:  e.modTime,
+					}
+					if e.err != nil {
+						child.Err = e.err.Error()
 					}
 
-					q = append(q, NodeP{child, cpath})
+					q = enqueue(q, NodeP{Node: child, Path: filepath.Join(it.l.path, e.name)})
 				}
 			}
 
-			out <- np
+			select {
+			case out <- it.np:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return out
 }
 
+// walkItem is a queued node, along with its pending listing if it is a
+// directory.
+type walkItem struct {
+	np NodeP
+	l  *listing
+}
+
+// listing holds the sorted, filtered entries of a directory once done is
+// closed.
+type listing struct {
+	path    string
+	entries []walkEntry
+	err     error
+	done    chan struct{}
+}
+
+// walkEntry is what we know of a directory entry. When err is set, only name
+// and mode type bits are reliable.
+type walkEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	err     error
+}
+
+func (l *listing) list(skip Skipper) {
+	defer close(l.done)
+
+	entries, err := readDirNames(l.path)
+	if err != nil {
+		l.err = err
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, e := range entries {
+		// Info saves us a lstat per entry on most filesystems
+		info, err := e.Info()
+		if err != nil {
+			if skip(entryInfo{e}) {
+				continue
+			}
+			l.entries = append(l.entries, walkEntry{name: e.Name(), mode: e.Type(), err: err})
+			continue
+		}
+		if skip(info) {
+			continue
+		}
+		l.entries = append(l.entries, walkEntry{
+			name:    info.Name(),
+			mode:    info.Mode(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+}
+
+// entryInfo is the FileInfo of an entry whose Info failed, for the Skipper to
+// be applied anyway. Only name and mode type bits are known, its size is -1.
+type entryInfo struct {
+	fs.DirEntry
+}
+
+func (i entryInfo) Size() int64        { return -1 }
+func (i entryInfo) Mode() fs.FileMode  { return i.Type() }
+func (i entryInfo) ModTime() time.Time { return time.Time{} }
+func (i entryInfo) Sys() any           { return nil }
+
 // readDirNames reads the directory named by dirname and returns
 // a list of directory entries.
 func readDirNames(dirname string) ([]fs.DirEntry, error) {
@@ -113,7 +231,8 @@ func readDirNames(dirname string) ([]fs.DirEntry, error) {
 	return names, nil
 }
 
-// Hasher... spy allows to follow hashing speed by having every hashed byte copied to it
+// Hasher... files that cannot be read are still emitted, with their Err set.
+// spy allows to follow hashing speed by having every hashed byte copied to it
 func Hasher(ctx context.Context, wd string, spy io.Writer, in <-chan NodeP) <-chan *Node {
 	out := make(chan *Node)
 	go func() {
@@ -127,11 +246,10 @@ func Hasher(ctx context.Context, wd string, spy io.Writer, in <-chan NodeP) <-ch
 				defer wg.Done()
 
 				for np := range in {
-					if !np.Node.Mode.IsDir() {
+					if !np.Node.Mode.IsDir() && np.Node.Err == "" {
 						err := computeHash(np, spy)
 						if err != nil {
-							log.Printf("Cannot hash %s: %s", np.Path, err)
-							continue
+							np.Node.Err = err.Error()
 						}
 					}
 					select {
@@ -165,22 +283,53 @@ func computeHash(n NodeP, spy io.Writer) error {
 	return nil
 }
 
-func Snapshot(root string, out, spy io.Writer) (c int) {
-	enc := gob.NewEncoder(out)
+// SnapshotOptions tunes how Snapshot encodes a filetree
+type SnapshotOptions struct {
+	// Canonical buffers all nodes, sorts them by path and renumbers them, so
+	// that identical filetrees yield identical node streams, and stores their
+	// Digest. Info and Footer still differ, compare digests rather than files.
+	Canonical bool
 
-	hs, err := os.Hostname()
-	if err != nil {
-		hs = "localhost"
-		log.Printf("Cannot get hostname: %s", err)
+	// Compression of the whole output, none by default
+	Compression Compression
+
+	// Recipients the output is encrypted for, after compression. Left empty,
+	// the output is not encrypted.
+	Recipients []Recipient
+
+	// Signer signs the snapshot checksum when set
+	Signer ed25519.PrivateKey
+
+	// Hostname recorded in place of the local one, for snapshots of remote
+	// filesystems
+	Hostname string
+}
+
+// snapshotSkipper leaves out anything but directories and non empty regular
+// files, and snapshots themselves along with their index
+func snapshotSkipper(n fs.FileInfo) bool {
+	return !n.Mode().IsDir() && (!n.Mode().IsRegular() || n.Size() == 0 ||
+		n.Name() == STATE_NAME || n.Name() == STATE_NAME+INDEX_SUFFIX)
+}
+
+func Snapshot(root string, out, spy io.Writer, opt SnapshotOptions) (c int) {
+	hs := opt.Hostname
+	if hs == "" {
+		var err error
+		if hs, err = os.Hostname(); err != nil {
+			hs = "localhost"
+			log.Printf("Cannot get hostname: %s", err)
+		}
 	}
 	// Write info node
-	err = enc.Encode(Info{
+	sw, err := newSnapshotWriter(out, Info{
 		Version:   VERSION,
 		RootPath:  root,
 		CreatedAt: time.Now(),
 		Nonce:     uuid.New(),
 		Hostname:  hs,
-	})
+		Canonical: opt.Canonical,
+	}, opt)
 	if err != nil {
 		panic(err)
 	}
@@ -189,17 +338,139 @@ func Snapshot(root string, out, spy io.Writer) (c int) {
 	ctx, cleanup := context.WithCancel(context.Background())
 	defer cleanup()
 
+	start := time.Now()
+
+	var skipped int64
 	skipper := func(n fs.FileInfo) bool {
-		return !n.Mode().IsDir() && (!n.Mode().IsRegular() || n.Size() == 0 || n.Name() == STATE_NAME)
+		skip := snapshotSkipper(n)
+		if skip {
+			atomic.AddInt64(&skipped, 1)
+		}
+		return skip
+	}
+
+	nodes := Hasher(ctx, root, spy, WalkFS(ctx, skipper, root))
+	if opt.Canonical {
+		nodes = canonical(nodes, sw.footer)
 	}
 
 	// Source by exploring all nodes and hash them
-	for x := range Hasher(ctx, root, spy, WalkFS(ctx, skipper, root)) {
+	for x := range nodes {
 		c++
-		if err := enc.Encode(x); err != nil {
+		if err := sw.Write(x); err != nil {
 			panic(err)
 		}
 	}
 
+	sw.footer.Skipped = atomic.LoadInt64(&skipped)
+	sw.footer.Duration = time.Since(start)
+	if err := sw.Close(); err != nil {
+		panic(err)
+	}
+
 	return
 }
+
+// snapshotWriter encodes a snapshot stream: Info, nodes, end marker,
+// directory hashes and footer, compressed, encrypted and signed according to
+// SnapshotOptions.
+type snapshotWriter struct {
+	ew, zw io.WriteCloser
+	enc    *gob.Encoder
+	sum    hash.Hash
+	signer ed25519.PrivateKey
+	footer *Footer
+	dirs   *dirHasher
+}
+
+func newSnapshotWriter(out io.Writer, i Info, opt SnapshotOptions) (*snapshotWriter, error) {
+	sw := &snapshotWriter{
+		ew:     nopWriteCloser{out},
+		sum:    sha256.New(),
+		signer: opt.Signer,
+		footer: NewFooter(),
+		dirs:   newDirHasher(),
+	}
+	if len(opt.Recipients) > 0 {
+		var err error
+		if sw.ew, err = Encrypt(out, opt.Recipients...); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if sw.zw, err = CompressSnapshot(sw.ew, opt.Compression); err != nil {
+		return nil, err
+	}
+	sw.enc = gob.NewEncoder(io.MultiWriter(sw.zw, sw.sum))
+	return sw, sw.enc.Encode(i)
+}
+
+// Write a node, accounting it in the footer and the hash of its directory
+func (sw *snapshotWriter) Write(n *Node) error {
+	sw.footer.Account(n)
+	sw.dirs.add(n)
+	return sw.enc.Encode(n)
+}
+
+// Close ends the node stream, and writes directory hashes and the footer. It
+// does not close the underlying writer.
+func (sw *snapshotWriter) Close() error {
+	if err := sw.enc.Encode(Node{ID: endOfNodesID}); err != nil {
+		return err
+	}
+	for _, d := range sw.dirs.finish() {
+		if err := sw.enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	if err := sw.enc.Encode(dirHash{ID: endOfNodesID}); err != nil {
+		return err
+	}
+	sw.footer.Checksum = sw.sum.Sum(nil)
+	if sw.signer != nil {
+		sw.footer.sign(sw.signer)
+	}
+	if err := writeFooter(sw.zw, sw.footer); err != nil {
+		return err
+	}
+	if err := sw.zw.Close(); err != nil {
+		return err
+	}
+	return sw.ew.Close()
+}
+
+// canonical drains in, then emits its nodes sorted by path with ids
+// reassigned in that order. The root keeps id 0. The tree Digest is stored in
+// footer.
+func canonical(in <-chan *Node, footer *Footer) <-chan *Node {
+	out := make(chan *Node)
+	go func() {
+		defer close(out)
+
+		t := NewTree()
+		for n := range in {
+			t.Add(n)
+		}
+		ns := t.sorted()
+		d := t.Digest()
+		footer.Digest = d[:]
+
+		ids := make(map[int]int, len(ns))
+		for i, n := range ns {
+			ids[n.ID] = i
+		}
+		for i, n := range ns {
+			out <- &Node{
+				Name:     n.Name,
+				Mode:     n.Mode,
+				Size:     n.Size,
+				ModTime:  n.ModTime,
+				Hash:     n.Hash,
+				ID:       i,
+				ParentID: ids[n.ParentID],
+				Err:      n.Err,
+			}
+		}
+	}()
+	return out
+}
@@ -1,8 +1,16 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/gob"
 	"io"
+	"io/fs"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/dav-m85/hsnap/memfs"
 	"github.com/matryer/is"
@@ -11,7 +19,7 @@ import (
 func readTree(is *is.I, root string) (tr *Tree) {
 	r, w := io.Pipe()
 	go func() {
-		Snapshot(root, w, io.Discard)
+		Snapshot(root, w, io.Discard, SnapshotOptions{})
 		w.Close()
 	}()
 
@@ -70,6 +78,275 @@ func TestTrimWithDuplicate(t *testing.T) {
 	is.Equal(len(nodes), 0)
 }
 
+// TestWalkFSOrder makes sure ids are stable across walks and parents are
+// emitted before their children
+func TestWalkFSOrder(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/b/c", 0777))
+	is.NoErr(rootFS.MkdirAll("d1/a", 0777))
+	is.NoErr(rootFS.WriteFile("d1/b/c/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/a/f2.txt", []byte("def"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/f3.txt", []byte("ghi"), 0755))
+
+	FS = rootFS
+
+	walk := func() map[string]int {
+		ids := make(map[string]int)
+		seen := make(map[int]bool)
+		for np := range WalkFS(context.Background(), nil, "d1") {
+			if np.Node.ID != 0 {
+				is.True(seen[np.Node.ParentID]) // parent emitted first
+			}
+			seen[np.Node.ID] = true
+			ids[np.Path] = np.Node.ID
+		}
+		return ids
+	}
+
+	first := walk()
+	is.Equal(len(first), 7)
+	is.Equal(first["d1/a"], 1)
+	is.Equal(first["d1/b"], 2)
+	for i := 0; i < 5; i++ {
+		is.Equal(walk(), first)
+	}
+}
+
+// TestCanonicalSnapshot checks that identical filetrees produce the same
+// nodes and digest, wherever they are rooted
+func TestCanonicalSnapshot(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	for _, root := range []string{"d1", "d2"} {
+		is.NoErr(rootFS.MkdirAll(root+"/a/b", 0777))
+		is.NoErr(rootFS.MkdirAll(root+"/a.b", 0777))
+		is.NoErr(rootFS.WriteFile(root+"/a/b/f1.txt", []byte("abc"), 0755))
+		is.NoErr(rootFS.WriteFile(root+"/a.b/f2.txt", []byte("def"), 0755))
+		is.NoErr(rootFS.WriteFile(root+"/f3.txt", []byte("ghi"), 0755))
+	}
+
+	FS = rootFS
+
+	var hashes []dirHash
+	snap := func(root string) (ns []Node, tr *Tree) {
+		var buf bytes.Buffer
+		Snapshot(root, &buf, io.Discard, SnapshotOptions{Canonical: true})
+		tr, err := ReadTree(bytes.NewReader(buf.Bytes()))
+		is.NoErr(err)
+		is.True(tr.Info.Canonical)
+
+		dec := gob.NewDecoder(&buf)
+		is.NoErr(dec.Decode(new(Info)))
+		is.NoErr(DecodeNodes(dec, func(n *Node) error {
+			ns = append(ns, *n)
+			return nil
+		}))
+		hs, ended, err := decodeDirHashes(dec)
+		is.NoErr(err)
+		is.True(ended)
+		hashes = hs
+		return
+	}
+
+	n1, t1 := snap("d1")
+	n2, t2 := snap("d2")
+
+	is.Equal(len(n1), 7)
+	// Root name and modification times differ, everything else is identical
+	n2[0].Name = n1[0].Name
+	for i := range n1 {
+		n1[i].ModTime, n2[i].ModTime = time.Time{}, time.Time{}
+	}
+	is.Equal(n1, n2)
+	is.Equal(t1.Digest(), t2.Digest())
+
+	// Sorted by path: a, a/b, a/b/f1.txt, a.b, ...
+	is.Equal(n1[1].Name, "a")
+	is.Equal(n1[2].Name, "b")
+	is.Equal(n1[3].Name, "f1.txt")
+	is.Equal(n1[4].Name, "a.b")
+
+	// Directory hashes are stored after the nodes, those of d2 here
+	a := t2.Search("a")
+	is.True(a.Hash != [sha1.Size]byte{})
+	is.Equal(len(hashes), 4)
+	found := false
+	for _, h := range hashes {
+		found = found || h == dirHash{a.ID, a.Hash}
+	}
+	is.True(found)
+
+	is.NoErr(rootFS.WriteFile("d2/a/b/f1.txt", []byte("abd"), 0755))
+	_, t2 = snap("d2")
+	is.True(t1.Digest() != t2.Digest())
+}
+
+// failingFS refuses to open or list a given path, and to give the info of
+// directory entries if noInfo
+type failingFS struct {
+	*memfs.FS
+	fail   string
+	noInfo bool
+}
+
+func (f failingFS) Open(name string) (fs.File, error) {
+	if name == f.fail {
+		return nil, fs.ErrPermission
+	}
+	return f.FS.Open(name)
+}
+
+func (f failingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == f.fail {
+		return nil, fs.ErrPermission
+	}
+	ds, err := f.FS.ReadDir(name)
+	if f.noInfo {
+		for i, d := range ds {
+			ds[i] = noInfoEntry{d}
+		}
+	}
+	return ds, err
+}
+
+type noInfoEntry struct {
+	fs.DirEntry
+}
+
+func (noInfoEntry) Info() (fs.FileInfo, error) {
+	return nil, fs.ErrPermission
+}
+
+// timedFS gives files the time they were written as modification time, which
+// memfs leaves out
+type timedFS struct {
+	*memfs.FS
+	times map[string]time.Time
+}
+
+func newTimedFS() *timedFS {
+	return &timedFS{memfs.New(), make(map[string]time.Time)}
+}
+
+func (f *timedFS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	f.times[path] = time.Now()
+	return f.FS.WriteFile(path, data, perm)
+}
+
+func (f *timedFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if t, ok := f.times[name]; ok && err == nil {
+		return timedFile{file, t}, nil
+	}
+	return file, err
+}
+
+func (f *timedFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := f.FS.Stat(name)
+	if t, ok := f.times[name]; ok && err == nil {
+		return timedInfo{fi, t}, nil
+	}
+	return fi, err
+}
+
+func (f *timedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ds, err := f.FS.ReadDir(name)
+	for i, d := range ds {
+		if t, ok := f.times[path.Join(name, d.Name())]; ok {
+			ds[i] = timedEntry{d, t}
+		}
+	}
+	return ds, err
+}
+
+type timedFile struct {
+	fs.File
+	t time.Time
+}
+
+func (f timedFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return timedInfo{fi, f.t}, nil
+}
+
+type timedInfo struct {
+	fs.FileInfo
+	t time.Time
+}
+
+func (i timedInfo) ModTime() time.Time {
+	return i.t
+}
+
+type timedEntry struct {
+	fs.DirEntry
+	t time.Time
+}
+
+func (e timedEntry) Info() (fs.FileInfo, error) {
+	fi, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return timedInfo{fi, e.t}, nil
+}
+
+// TestUnreadable makes sure unreadable nodes are kept in the snapshot, and
+// never matched while trimming
+func TestUnreadable(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/locked", 0777))
+	is.NoErr(rootFS.WriteFile("d1/locked/f0.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/f2.txt", []byte("def"), 0755))
+	is.NoErr(rootFS.MkdirAll("d2", 0777))
+	is.NoErr(rootFS.WriteFile("d2/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/f2.txt", []byte("def"), 0755))
+
+	FS = failingFS{FS: rootFS, fail: "d1/f2.txt"}
+	t1 := readTree(is, "d1")
+	FS = failingFS{FS: rootFS, fail: "d1/locked"}
+	t1bis := readTree(is, "d1")
+	FS = rootFS
+	t2 := readTree(is, "d2")
+
+	failed := t1.Failed()
+	is.Equal(len(failed), 1)
+	is.Equal(failed[0].Name, "f2.txt")
+	is.Equal(failed[0].Err, fs.ErrPermission.Error())
+
+	hg := t1.Trim(t2)
+	hg.PruneSingleTreeGroups()
+	N(hg.Select(t1)).Equal(is, "f0.txt", "f1.txt")
+
+	failed = t1bis.Failed()
+	is.Equal(len(failed), 1)
+	is.True(failed[0].Mode.IsDir())
+	is.True(t1bis.Search("locked/f0.txt") == nil)
+
+	// Entries without info are still recorded, unless skipped by name
+	is.NoErr(rootFS.WriteFile("d2/"+STATE_NAME, []byte("snap"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/"+STATE_NAME+INDEX_SUFFIX, []byte("idx"), 0755))
+	FS = failingFS{FS: rootFS, noInfo: true}
+	t2bis := readTree(is, "d2")
+	FS = rootFS
+	is.True(t2bis.Search(STATE_NAME) == nil)
+	is.True(t2bis.Search(STATE_NAME+INDEX_SUFFIX) == nil)
+	is.True(readTree(is, "d2").Search(STATE_NAME+INDEX_SUFFIX) == nil)
+	is.Equal(len(t2bis.Failed()), 2)
+}
+
 func TestSelfTrim(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/fs"
+)
+
+// Status compares the tree to the live filesystem at root, the way it would
+// be snapshotted. Files are compared by size and modification time, or by
+// content when rehash is set, in which case every file is read again and
+// spy receives the hashed bytes. Moves are only detected when rehashing.
+func (t *Tree) Status(root string, spy io.Writer, rehash bool) (*Diff, error) {
+	if _, err := FS.(fs.StatFS).Stat(root); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	live := NewTree()
+	live.Info = &Info{RootPath: root}
+	nodes := WalkFS(ctx, snapshotSkipper, root)
+	if rehash {
+		for n := range Hasher(ctx, root, spy, nodes) {
+			live.Add(n)
+		}
+	} else {
+		for np := range nodes {
+			live.Add(np.Node)
+		}
+	}
+
+	return diffTrees(t, live, func(o, n *Node) string {
+		// Live hashes are only known when rehashing, otherwise files of the
+		// same size are told apart by their modification time
+		c := contentChange(o, n)
+		switch {
+		case c != "content" || rehash:
+			return c
+		case o.ModTime.IsZero() || o.ModTime.Equal(n.ModTime):
+			return ""
+		}
+		return "mtime"
+	}), nil
+}
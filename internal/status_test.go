@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"io"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestStatus(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := newTimedFS()
+
+	is.NoErr(rootFS.MkdirAll("d1/a", 0777))
+	is.NoErr(rootFS.WriteFile("d1/a/same.txt", []byte("same"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/a/touched.txt", []byte("touched"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/a/edited.txt", []byte("edited"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/grown.txt", []byte("grown"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/gone.txt", []byte("gone"), 0755))
+
+	FS = rootFS
+	tr := readTree(is, "d1")
+
+	// d1 as it is later on, memfs cannot remove files
+	is.NoErr(rootFS.MkdirAll("d2/a", 0777))
+	is.NoErr(rootFS.WriteFile("d2/a/touched.txt", []byte("touched"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/a/edited.txt", []byte("EDITED"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/grown.txt", []byte("grown up"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/a/new.txt", []byte("new"), 0755))
+	is.NoErr(rootFS.WriteFile("d2/a/empty.txt", []byte{}, 0755)) // skipped
+	same, err := rootFS.Stat("d1/a/same.txt")
+	is.NoErr(err)
+	is.True(same.ModTime().Equal(tr.Search("a/same.txt").ModTime))
+
+	changes := func(d *Diff) (cs []string) {
+		for _, c := range d.Changes {
+			if c.Kind != Unchanged {
+				cs = append(cs, string(c.Kind)+" "+c.Path+" "+c.Reason)
+			}
+		}
+		return
+	}
+
+	d, err := tr.Status("d2", io.Discard, false)
+	is.NoErr(err)
+	is.Equal(changes(d), []string{
+		"modified a/edited.txt mtime",
+		"added a/new.txt ",
+		"removed a/same.txt ",
+		"modified a/touched.txt mtime",
+		"removed gone.txt ",
+		"modified grown.txt size",
+	})
+
+	d, err = tr.Status("d2", io.Discard, true)
+	is.NoErr(err)
+	is.Equal(changes(d), []string{
+		"modified a/edited.txt content",
+		"added a/new.txt ",
+		"removed a/same.txt ",
+		"removed gone.txt ",
+		"modified grown.txt size",
+	})
+
+	d, err = tr.Status("d1", io.Discard, false)
+	is.NoErr(err)
+	is.Equal(changes(d), nil)
+
+	_, err = tr.Status("nope", io.Discard, false)
+	is.True(err != nil)
+}
@@ -1,12 +1,19 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"io/fs"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,18 +28,44 @@ type Info struct {
 	Version   int
 	Nonce     uuid.UUID
 	Hostname  string
+	Canonical bool // nodes are sorted by path, see SnapshotOptions
+
+	// Sources of a catalog, see Merge
+	Sources []Source
+
+	// DerivedFrom lists the nonces of the snapshots this one was extracted
+	// from, closest first, see Extract
+	DerivedFrom []uuid.UUID
 }
 
 func (i *Info) String() string {
+	if i.IsCatalog() {
+		return fmt.Sprintf("catalog of %d snapshots (v%d %s)", len(i.Sources), i.Version, i.Nonce.String()[:8])
+	}
 	return fmt.Sprintf("%s@%s (v%d %s)", i.Hostname, i.RootPath, i.Version, i.Nonce.String()[:8])
 }
 
 // Tree structure that holds a filesystem
 type Tree struct {
-	Info     *Info
-	Name     string
+	Info   *Info
+	Footer *Footer // nil for snapshots prior to version 2
+	Name   string
+
+	// Integrity as found by ReadTree. Nodes read up to a truncation or
+	// corruption are kept in the tree, it is up to callers to use them.
+	Integrity Integrity
+
 	nodes    map[int]*Node
 	children map[int][]int
+
+	// Lazily built lookups, reset by Add
+	mu      sync.Mutex
+	paths   map[int]string
+	byPath  map[string]*Node
+	sources map[int]*Source // by node ID, see Source
+
+	// Directory stats, see HashDirs, reset by Add
+	stats map[int]DirStats
 }
 
 func NewTree() *Tree {
@@ -42,47 +75,146 @@ func NewTree() *Tree {
 	}
 }
 
-// ReadTree into a Tree, usually from a fs.Open
-func ReadTree(r io.Reader) (*Tree, error) {
+// ReadTree into a Tree, usually from a fs.Open. Compressed snapshots are
+// detected and decompressed, encrypted ones are opened with the first of ids
+// that can. Truncated or corrupt snapshots return an error
+// wrapping ErrTruncated, ErrCorrupt or ErrChecksum, along with the nodes read
+// so far that are still attached to the root, see Tree.Integrity.
+func ReadTree(r io.Reader, ids ...Identity) (*Tree, error) {
 	t := NewTree()
+	hashes, err := t.read(r, ids...)
+	switch {
+	case t.Integrity == Complete && t.Info.Version >= 3:
+		for _, d := range hashes {
+			if n, ok := t.nodes[d.ID]; ok && n.Mode.IsDir() {
+				n.Hash = d.Hash
+			}
+		}
+		t.sumDirs(false)
+	case t.Integrity == Complete || t.Integrity == Unverified:
+		t.HashDirs()
+	default:
+		// Directories may miss part of their content, they keep a zero hash
+		t.prune()
+		t.sumDirs(false)
+	}
+	return t, err
+}
 
-	dec := gob.NewDecoder(r)
+// read the snapshot nodes into t, along with the directory hashes stored
+// after them
+func (t *Tree) read(r io.Reader, ids ...Identity) ([]dirHash, error) {
+	dr, _, err := Decompress(r, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	// gob reads exactly what it needs from a ByteReader, which lets us read
+	// the footer past the node stream, and checksum exactly the node stream
+	br := bufio.NewReader(dr)
+	hr := &hashingReader{br, sha256.New()}
+	dec := gob.NewDecoder(hr)
 
 	i := new(Info)
 	if err := dec.Decode(i); err != nil {
-		return t, err
+		t.Integrity, err = integrityError(err)
+		return nil, err
 	}
 
-	if i.Version != VERSION {
-		panic("Not version 1")
+	if i.Version < 1 || i.Version > VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d", i.Version)
 	}
 
 	t.Info = i
 
-	err := DecodeNodes(dec, func(n *Node) error {
+	ended, err := decodeNodes(dec, func(n *Node) error {
 		t.Add(n)
 		return nil
 	})
+	var hashes []dirHash
+	if err == nil && ended && i.Version >= 3 {
+		hashes, ended, err = decodeDirHashes(dec)
+	}
+	if err != nil {
+		t.Integrity, err = integrityError(err)
+		return nil, err
+	}
+	if i.Version < 2 {
+		return nil, nil
+	}
+	if !ended {
+		t.Integrity = Truncated
+		return nil, ErrTruncated
+	}
 
-	return t, err
+	sum := hr.h.Sum(nil)
+	if t.Footer, err = readFooter(br); err != nil {
+		t.Integrity, err = integrityError(err)
+		return nil, err
+	}
+	// Nothing follows the footer, reading up to EOF also checks the trailer
+	// of compressed streams
+	if n, err := io.Copy(io.Discard, br); err != nil || n > 0 {
+		if err == nil {
+			err = fmt.Errorf("%w: %d bytes past the footer", ErrCorrupt, n)
+		}
+		t.Integrity, err = integrityError(err)
+		return nil, err
+	}
+	if t.Footer.Checksum != nil && !bytes.Equal(t.Footer.Checksum, sum) {
+		t.Integrity = Corrupt
+		return nil, ErrChecksum
+	}
+	t.Integrity = Complete
+	return hashes, nil
 }
 
+// decodeDirHashes reads the directory hashes following the end of nodes, and
+// tells whether they ended with their end marker
+func decodeDirHashes(dec *gob.Decoder) (hs []dirHash, ended bool, err error) {
+	for {
+		var d dirHash
+		err := dec.Decode(&d)
+		if err == io.EOF {
+			return hs, false, nil
+		}
+		if err != nil {
+			return hs, false, err
+		}
+		if d.ID == endOfNodesID {
+			return hs, true, nil
+		}
+		hs = append(hs, d)
+	}
+}
+
+// DecodeNodes calls hf for each node of the stream, until its end marker or
+// EOF for snapshots prior to version 2.
 func DecodeNodes(dec *gob.Decoder, hf func(*Node) error) error {
+	_, err := decodeNodes(dec, hf)
+	return err
+}
+
+// decodeNodes tells whether the stream ended with its end marker
+func decodeNodes(dec *gob.Decoder, hf func(*Node) error) (ended bool, err error) {
 	for {
 		n := new(Node)
 		err := dec.Decode(n)
 		if err == io.EOF {
-			break
+			return false, nil
 		}
 		if err != nil {
-			return err
+			return false, err
+		}
+		if n.ID == endOfNodesID {
+			return true, nil
 		}
 		err = hf(n)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
-	return nil
 }
 
 func (t *Tree) Node(id int) *Node {
@@ -99,6 +231,43 @@ func (t *Tree) Add(n *Node) {
 	}
 	t.children[n.ParentID] = append(t.children[n.ParentID], n.ID)
 	n.tree = t
+
+	t.mu.Lock()
+	t.paths, t.byPath, t.sources, t.stats = nil, nil, nil, nil
+	t.mu.Unlock()
+}
+
+// prune drops the nodes cut off from the root, whose parent was lost along
+// with the end of a truncated or corrupt snapshot
+func (t *Tree) prune() {
+	var root *Node
+	for _, id := range []int{0, 1} {
+		if n, ok := t.nodes[id]; ok {
+			root = n
+			break
+		}
+	}
+	keep := make(map[int]bool, len(t.nodes))
+	if root != nil {
+		t.WalkFrom(root, func(_ string, n *Node) error {
+			keep[n.ID] = true
+			return nil
+		})
+	}
+	for id := range t.nodes {
+		if !keep[id] {
+			delete(t.nodes, id)
+		}
+	}
+	for id := range t.children {
+		if !keep[id] {
+			delete(t.children, id)
+		}
+	}
+
+	t.mu.Lock()
+	t.paths, t.byPath, t.sources, t.stats = nil, nil, nil, nil
+	t.mu.Unlock()
 }
 
 func (t *Tree) Root() *Node {
@@ -111,59 +280,170 @@ func (t *Tree) Root() *Node {
 	panic("No root node in tree")
 }
 
+// Search a node by its relative path. The first call indexes all paths.
 func (t *Tree) Search(path string) *Node {
-	for _, x := range t.nodes {
-		rel := t.RelPath(x)
-		if rel == path {
-			return x
+	path = filepath.Clean("/" + path)[1:]
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byPath == nil {
+		t.byPath = make(map[string]*Node, len(t.nodes))
+		for _, x := range t.nodes {
+			t.byPath[t.relPath(x)] = x
 		}
 	}
-	return nil
+	return t.byPath[path]
 }
 
 func (t *Tree) ChildrenOf(n *Node) (ns Nodes) {
 	if n == nil {
 		panic("oops")
 	}
-	for _, x := range t.nodes {
-		if x.ParentID == n.ID {
-			ns = append(ns, x)
+	for _, id := range t.children[n.ID] {
+		if id != n.ID { // root can be its own parent
+			ns = append(ns, t.nodes[id])
 		}
 	}
 	return
 }
 
+// WalkFunc is called for each node visited by Walk, with its relative path.
+// Returning fs.SkipDir skips the remaining of a directory, any other error
+// stops the walk.
+type WalkFunc func(path string, n *Node) error
+
+// Walk the tree depth first from its root, see WalkFrom
+func (t *Tree) Walk(fn WalkFunc) error {
+	return t.WalkFrom(t.Root(), fn)
+}
+
+// WalkFrom walks the subtree rooted at n depth first, parents before their
+// children, children in the order they were added.
+func (t *Tree) WalkFrom(n *Node, fn WalkFunc) error {
+	type item struct {
+		path string
+		n    *Node
+	}
+	stack := []item{{t.RelPath(n), n}}
+	var it item
+	for len(stack) > 0 {
+		it, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		err := fn(it.path, it.n)
+		if err == fs.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cs := t.children[it.n.ID]
+		for i := len(cs) - 1; i >= 0; i-- {
+			if cs[i] == it.n.ID {
+				continue
+			}
+			c := t.nodes[cs[i]]
+			stack = append(stack, item{filepath.Join(it.path, c.Name), c})
+		}
+	}
+	return nil
+}
+
+// RelPath of a node within its tree. Resolved paths are cached.
 func (t *Tree) RelPath(n *Node) (path string) {
 	if n.tree != t {
 		panic("wrong tree used for resolving path")
 	}
-	on := n
-	for n.ID > 0 {
-		var pn *Node
-		var ok bool
-		if pn, ok = t.nodes[n.ParentID]; !ok {
-			if n.ParentID == 0 { // Some legacy hsnap need this
-				return
-			}
-			panic(fmt.Sprintf("cannot resolve full path for %s, missing parent for %s in %s", on, pn, t.Info))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.relPath(n)
+}
+
+func (t *Tree) relPath(n *Node) string {
+	if n.ID <= 0 {
+		return ""
+	}
+	if p, ok := t.paths[n.ID]; ok {
+		return p
+	}
+	pn, ok := t.nodes[n.ParentID]
+	if !ok {
+		if n.ParentID == 0 { // Some legacy hsnap need this
+			return ""
 		}
-		path = filepath.Join(n.Name, path)
-		n = pn
+		panic(fmt.Sprintf("cannot resolve full path for %s, missing parent %d in %s", n, n.ParentID, t.Info))
 	}
-	return
+	path := filepath.Join(t.relPath(pn), n.Name)
+	if t.paths == nil {
+		t.paths = make(map[int]string, len(t.nodes))
+	}
+	t.paths[n.ID] = path
+	return path
 }
 
+// AbsPath of a node on the host it was snapshotted from. Catalog nodes are
+// resolved within the root of their source.
 func (t *Tree) AbsPath(n *Node) (path string) {
+	if src := t.Source(n); src != nil {
+		rel := t.RelPath(n)
+		if i := strings.IndexRune(rel, filepath.Separator); i >= 0 {
+			return filepath.Join(src.RootPath, rel[i+1:])
+		}
+		return src.RootPath
+	}
 	return filepath.Join(t.Info.RootPath, t.RelPath(n))
 }
 
+// sorted returns all nodes ordered by path, a parent always coming before its
+// children.
+func (t *Tree) sorted() Nodes {
+	type keyed struct {
+		key string
+		n   *Node
+	}
+	ks := make([]keyed, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		ks = append(ks, keyed{pathKey(t.RelPath(n)), n})
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].key < ks[j].key
+	})
+	ns := make(Nodes, len(ks))
+	for i, k := range ks {
+		ns[i] = k.n
+	}
+	return ns
+}
+
+// Digest is a sha256 of the tree content: relative paths, modes, file sizes
+// and hashes. It ignores ids, emission order and the Info header, so two
+// snapshots of identical filetrees share the same Digest.
+func (t *Tree) Digest() (d [sha256.Size]byte) {
+	h := sha256.New()
+	var buf [12]byte
+	for _, n := range t.sorted() {
+		io.WriteString(h, t.RelPath(n))
+		h.Write([]byte{0})
+		binary.BigEndian.PutUint32(buf[:4], uint32(n.Mode))
+		if !n.Mode.IsDir() { // directory size depends on the filesystem
+			binary.BigEndian.PutUint64(buf[4:], uint64(n.Size))
+			h.Write(buf[:])
+			h.Write(n.Hash[:])
+		} else { // directory hashes derive from their files
+			binary.BigEndian.PutUint64(buf[4:], 0)
+			h.Write(buf[:])
+			h.Write(make([]byte, sha1.Size))
+		}
+	}
+	copy(d[:], h.Sum(nil))
+	return
+}
+
 func (t *Tree) Trim(withs ...*Tree) HashGroup {
 	matches := make(HashGroup)
 	for _, n := range t.nodes {
 		matches.Add(n)
 	}
 	for _, tx := range withs {
-		if t.Info.Nonce == tx.Info.Nonce {
+		if t.Overlaps(tx) {
 			panic("cannot trim with self")
 		}
 		for _, m := range tx.nodes {
@@ -174,24 +454,39 @@ func (t *Tree) Trim(withs ...*Tree) HashGroup {
 	return matches
 }
 
+// Failed lists nodes that could not be read while snapshotting, sorted by path
+func (t *Tree) Failed() (ns Nodes) {
+	for _, n := range t.sorted() {
+		if n.Failed() {
+			ns = append(ns, n)
+		}
+	}
+	return
+}
+
+// Check lists nodes that are missing under prefix. Descendants of a missing
+// directory are reported without being looked up.
 func (t *Tree) Check(prefix string) (missing Nodes) {
 	lstat := FS.(fs.StatFS).Stat
-	for _, n := range t.nodes {
-		p := filepath.Join(prefix, t.RelPath(n))
-		_, err := lstat(p)
-		if err != nil {
-			missing = append(missing, n)
+	t.Walk(func(path string, n *Node) error {
+		if _, err := lstat(filepath.Join(prefix, path)); err == nil {
+			return nil
 		}
-	}
+		t.WalkFrom(n, func(_ string, x *Node) error {
+			missing = append(missing, x)
+			return nil
+		})
+		return fs.SkipDir
+	})
 	return
 }
 
 // HashGroup helps comparing Hashes pretty quickly
 type HashGroup map[[sha1.Size]byte][]*Node
 
-// Add a Node slice to HashGroup
+// Add a Node slice to HashGroup. Directories and failed nodes are ignored.
 func (r HashGroup) Add(n *Node) {
-	if n.Mode.IsDir() {
+	if n.Mode.IsDir() || n.Failed() {
 		return
 	}
 	if grp, ok := r[n.Hash]; ok {
@@ -209,7 +504,7 @@ func (r HashGroup) Add(n *Node) {
 
 // Intersect adds nodes if their hash is already present (does not create new groups)
 func (r HashGroup) Intersect(n *Node) {
-	if n.Mode.IsDir() {
+	if n.Mode.IsDir() || n.Failed() {
 		return
 	}
 	if grp, ok := r[n.Hash]; ok {
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestTreeWalk(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/a/b", 0777))
+	is.NoErr(rootFS.MkdirAll("d1/c", 0777))
+	is.NoErr(rootFS.WriteFile("d1/a/b/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/a/f2.txt", []byte("def"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/c/f3.txt", []byte("ghi"), 0755))
+
+	FS = rootFS
+
+	tr := readTree(is, "d1")
+
+	var paths []string
+	is.NoErr(tr.Walk(func(path string, n *Node) error {
+		is.Equal(path, tr.RelPath(n))
+		paths = append(paths, path)
+		if path == "a/b" {
+			return fs.SkipDir
+		}
+		return nil
+	}))
+	is.Equal(paths, []string{"", "a", "a/b", "a/f2.txt", "c", "c/f3.txt"})
+
+	is.Equal(tr.Search("/a/b/../f2.txt").Name, "f2.txt")
+	is.True(tr.Search("a/nope") == nil)
+	is.Equal(tr.Search(""), tr.Root())
+
+	var names []string
+	for _, n := range tr.ChildrenOf(tr.Root()) {
+		names = append(names, n.Name)
+	}
+	is.Equal(names, []string{"a", "c"})
+
+	// Nodes added later are found too
+	tr.Add(&Node{ID: 100, ParentID: tr.Search("c").ID, Name: "f4.txt"})
+	is.Equal(tr.Search("c/f4.txt").ID, 100)
+}
+
+func TestCheck(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("d1/a/b", 0777))
+	is.NoErr(rootFS.WriteFile("d1/a/b/f1.txt", []byte("abc"), 0755))
+	is.NoErr(rootFS.WriteFile("d1/f2.txt", []byte("def"), 0755))
+
+	FS = rootFS
+	tr := readTree(is, "d1")
+
+	other := memfs.New()
+	is.NoErr(other.MkdirAll("d1", 0777))
+	is.NoErr(other.WriteFile("d1/f2.txt", []byte("def"), 0755))
+	FS = other
+
+	N(tr.Check("d1")).Equal(is, "a", "b", "f1.txt")
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// FS of the tree, for fs.WalkDir and the like, or WalkFS once set as the
+// package FS. Paths are relative to the tree root, "." being the root itself.
+// It holds metadata only: files read as empty, and the Sys of their FileInfo
+// is their *Node, carrying the Hash. Listing a directory that failed while
+// snapshotting returns its error.
+func (t *Tree) FS() fs.FS {
+	return treeFS{t}
+}
+
+type treeFS struct {
+	t *Tree
+}
+
+// node found at name, any error being a *fs.PathError for op
+func (f treeFS) node(op, name string) (*Node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := f.t.Search(name)
+	if n == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+func (f treeFS) Open(name string) (fs.File, error) {
+	n, err := f.node("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &treeFile{fs: f, name: name, n: n}, nil
+}
+
+func (f treeFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.node("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return nodeInfo{n}, nil
+}
+
+// ReadDir lists name sorted by file name
+func (f treeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.node("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if n.Failed() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New(n.Err)}
+	}
+	var ds []fs.DirEntry
+	for _, c := range f.t.ChildrenOf(n) {
+		ds = append(ds, fs.FileInfoToDirEntry(nodeInfo{c}))
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		return ds[i].Name() < ds[j].Name()
+	})
+	return ds, nil
+}
+
+// treeFile is an opened file or directory of a treeFS
+type treeFile struct {
+	fs   treeFS
+	name string
+	n    *Node
+
+	entries []fs.DirEntry // nil until read
+	closed  bool
+}
+
+func (f *treeFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return nodeInfo{f.n}, nil
+}
+
+func (f *treeFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.n.Mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return 0, io.EOF
+}
+
+func (f *treeFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile, resuming where the previous call stopped
+func (f *treeFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.entries == nil {
+		ds, err := f.fs.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = append([]fs.DirEntry{}, ds...)
+	}
+	if count <= 0 {
+		ds := f.entries
+		f.entries = f.entries[len(ds):]
+		return ds, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	ds := f.entries[:count]
+	f.entries = f.entries[count:]
+	return ds, nil
+}
+
+// nodeInfo is the fs.FileInfo of a node
+type nodeInfo struct {
+	n *Node
+}
+
+// Name of the node, "." for the root as with os.DirFS
+func (i nodeInfo) Name() string {
+	if i.n == i.n.tree.Root() {
+		return "."
+	}
+	return i.n.Name
+}
+
+func (i nodeInfo) Size() int64 {
+	return i.n.Size
+}
+
+func (i nodeInfo) Mode() fs.FileMode {
+	return i.n.Mode
+}
+
+func (i nodeInfo) ModTime() time.Time {
+	return i.n.ModTime
+}
+
+func (i nodeInfo) IsDir() bool {
+	return i.n.Mode.IsDir()
+}
+
+// Sys is the *Node, carrying the Hash
+func (i nodeInfo) Sys() any {
+	return i.n
+}
+
+var _ fs.ReadDirFS = treeFS{}
+var _ fs.StatFS = treeFS{}
+var _ fs.ReadDirFile = &treeFile{}
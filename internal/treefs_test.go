@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestTreeFS(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+	is.NoErr(rootFS.MkdirAll("d1/album/empty", 0777))
+	is.NoErr(rootFS.WriteFile("d1/album/a.jpg", []byte("aaaa"), 0640))
+	is.NoErr(rootFS.WriteFile("d1/album/b.jpg", []byte("bbbb"), 0640))
+	is.NoErr(rootFS.WriteFile("d1/c.txt", []byte("cc"), 0640))
+
+	FS = rootFS
+	tr := readTree(is, "d1")
+	tfs := tr.FS()
+
+	is.NoErr(fstest.TestFS(tfs, "album/a.jpg", "album/b.jpg", "album/empty", "c.txt"))
+
+	// Metadata of the snapshot, the hash as Sys
+	fi, err := fs.Stat(tfs, "album/a.jpg")
+	is.NoErr(err)
+	is.Equal(fi.Size(), int64(4))
+	is.Equal(fi.Mode(), fs.FileMode(0640))
+	is.Equal(fi.Sys().(*Node).Hash, tr.Search("album/a.jpg").Hash)
+	_, err = fs.Stat(tfs, "nope")
+	is.True(err != nil)
+
+	var walked []string
+	is.NoErr(fs.WalkDir(tfs, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	}))
+	is.Equal(walked, []string{".", "album", "album/a.jpg", "album/b.jpg", "album/empty", "c.txt"})
+
+	// hsnap walks it as any filesystem
+	FS = tfs
+	var paths []string
+	for np := range WalkFS(context.Background(), nil, ".") {
+		paths = append(paths, np.Path)
+	}
+	is.Equal(len(paths), 6)
+	is.Equal(paths[0], ".")
+}
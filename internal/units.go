@@ -1,6 +1,10 @@
 package internal
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 const (
 	B  = 1
@@ -27,3 +31,21 @@ func (b ByteSize) String() string {
 	return fmt.Sprintf("%.1f%c",
 		float64(b)/float64(div), "KMGTPE"[exp])
 }
+
+// ParseByteSize reads a byte quantity like 512, 10k or 1.5G, units being
+// powers of 1024 and case insensitive, with an optional trailing B.
+func ParseByteSize(s string) (ByteSize, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if v != "" {
+		if exp := strings.IndexByte("KMGTPE", v[len(v)-1]); exp >= 0 {
+			mult = 1 << (10 * (exp + 1))
+			v = v[:len(v)-1]
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(f * float64(mult)), nil
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+)
+
+// Located is a local file looked up in snapshots by Which
+type Located struct {
+	Path    string
+	Node    *Node // Err is set when the file could not be read
+	Matches Nodes // files of the snapshots with the same content
+}
+
+// Which hashes the files at paths, directories recursively, the way they would
+// be snapshotted, and looks them up by content in trees. Files a snapshot
+// would leave out, like empty ones, are not looked up. spy receives the
+// hashed bytes. Files of a directory are sorted by path.
+func Which(paths []string, spy io.Writer, trees ...*Tree) (ls []Located, err error) {
+	known := make(HashGroup)
+	for _, t := range trees {
+		for _, n := range t.nodes {
+			if dupable(n) {
+				known.Add(n)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, path := range paths {
+		fi, err := FS.(fs.StatFS).Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if snapshotSkipper(fi) {
+				return nil, errors.New(path + " is not a file a snapshot would hold")
+			}
+			n := &Node{Name: fi.Name(), Mode: fi.Mode(), Size: fi.Size(), ModTime: fi.ModTime()}
+			if err := computeHash(NodeP{Node: n, Path: path}, spy); err != nil {
+				n.Err = err.Error()
+			}
+			ls = append(ls, Located{path, n, known[n.Hash]})
+			continue
+		}
+
+		live := NewTree()
+		live.Info = &Info{RootPath: path}
+		for n := range Hasher(ctx, path, spy, WalkFS(ctx, snapshotSkipper, path)) {
+			live.Add(n)
+		}
+		// Hashing runs concurrently, sort files back by path
+		from := len(ls)
+		live.Walk(func(rel string, n *Node) error {
+			if n.Mode.IsDir() && !n.Failed() {
+				return nil
+			}
+			l := Located{Path: filepath.Join(path, rel), Node: n}
+			if !n.Failed() {
+				l.Matches = known[n.Hash]
+			}
+			ls = append(ls, l)
+			return nil
+		})
+		found := ls[from:]
+		sort.Slice(found, func(i, j int) bool { return pathKey(found[i].Path) < pathKey(found[j].Path) })
+	}
+	return
+}
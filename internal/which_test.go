@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"io"
+	"testing"
+
+	"github.com/dav-m85/hsnap/memfs"
+	"github.com/matryer/is"
+)
+
+func TestWhich(t *testing.T) {
+	is := is.New(t)
+
+	rootFS := memfs.New()
+
+	is.NoErr(rootFS.MkdirAll("nas/photos", 0777))
+	is.NoErr(rootFS.MkdirAll("local/sub", 0777))
+	is.NoErr(rootFS.WriteFile("nas/photos/a.jpg", []byte("aaaa"), 0755))
+	is.NoErr(rootFS.WriteFile("nas/b.jpg", []byte("aaaa"), 0755))
+	is.NoErr(rootFS.WriteFile("local/a.jpg", []byte("aaaa"), 0755))
+	is.NoErr(rootFS.WriteFile("local/sub/c.jpg", []byte("cccc"), 0755))
+	is.NoErr(rootFS.WriteFile("local/empty", nil, 0755))
+
+	FS = rootFS
+	nas := readTree(is, "nas")
+
+	ls, err := Which([]string{"local/a.jpg"}, io.Discard, nas)
+	is.NoErr(err)
+	is.Equal(len(ls), 1)
+	is.Equal(ls[0].Path, "local/a.jpg")
+	is.Equal(len(ls[0].Matches), 2)
+
+	// Directories are walked, leaving out what a snapshot would
+	ls, err = Which([]string{"local"}, io.Discard, nas)
+	is.NoErr(err)
+	is.Equal(len(ls), 2)
+	is.Equal(ls[0].Path, "local/a.jpg")
+	is.Equal(len(ls[0].Matches), 2)
+	is.Equal(ls[1].Path, "local/sub/c.jpg")
+	is.Equal(len(ls[1].Matches), 0)
+
+	_, err = Which([]string{"local/empty"}, io.Discard, nas)
+	is.True(err != nil)
+	_, err = Which([]string{"local/nope"}, io.Discard, nas)
+	is.True(err != nil)
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ed25519"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -18,7 +25,7 @@ import (
 	bar "github.com/schollz/progressbar/v3"
 )
 
-var wd, spath string
+var wd, spath, identity string
 var delete, quiet bool
 
 var version string = "dev"
@@ -50,6 +57,21 @@ var (
 	trimCmd    = flag.NewFlagSet("trim", flag.ExitOnError)
 	listCmd    = flag.NewFlagSet("ls", flag.ExitOnError)
 	checkCmd   = flag.NewFlagSet("check", flag.ExitOnError)
+	indexCmd   = flag.NewFlagSet("index", flag.ExitOnError)
+	convertCmd = flag.NewFlagSet("convert", flag.ExitOnError)
+	keygenCmd  = flag.NewFlagSet("keygen", flag.ExitOnError)
+	verifyCmd  = flag.NewFlagSet("verify-sig", flag.ExitOnError)
+	errorsCmd  = flag.NewFlagSet("errors", flag.ExitOnError)
+	diffCmd    = flag.NewFlagSet("diff", flag.ExitOnError)
+	statusCmd  = flag.NewFlagSet("status", flag.ExitOnError)
+	mergeCmd   = flag.NewFlagSet("merge", flag.ExitOnError)
+	extractCmd = flag.NewFlagSet("extract", flag.ExitOnError)
+	dupCmd     = flag.NewFlagSet("dup", flag.ExitOnError)
+	duCmd      = flag.NewFlagSet("du", flag.ExitOnError)
+	findCmd    = flag.NewFlagSet("find", flag.ExitOnError)
+	whichCmd   = flag.NewFlagSet("which", flag.ExitOnError)
+	serveCmd   = flag.NewFlagSet("serve", flag.ExitOnError)
+	mountCmd   = flag.NewFlagSet("mount", flag.ExitOnError)
 	versionCmd = flag.NewFlagSet("version", flag.ExitOnError)
 )
 
@@ -61,6 +83,21 @@ var subcommands = map[string]*flag.FlagSet{
 	trimCmd.Name():    trimCmd,
 	listCmd.Name():    listCmd,
 	checkCmd.Name():   checkCmd,
+	indexCmd.Name():   indexCmd,
+	convertCmd.Name(): convertCmd,
+	keygenCmd.Name():  keygenCmd,
+	verifyCmd.Name():  verifyCmd,
+	errorsCmd.Name():  errorsCmd,
+	diffCmd.Name():    diffCmd,
+	statusCmd.Name():  statusCmd,
+	mergeCmd.Name():   mergeCmd,
+	extractCmd.Name(): extractCmd,
+	dupCmd.Name():     dupCmd,
+	duCmd.Name():      duCmd,
+	findCmd.Name():    findCmd,
+	whichCmd.Name():   whichCmd,
+	serveCmd.Name():   serveCmd,
+	mountCmd.Name():   mountCmd,
 	versionCmd.Name(): versionCmd,
 }
 
@@ -68,10 +105,103 @@ func setupCommonFlags() {
 	for _, fs := range subcommands {
 		fs.StringVar(&spath, "hsnap", "", "Use a different .hsnap file")
 		fs.StringVar(&wd, "wd", "", "Use a different working directory")
+		fs.StringVar(&identity, "identity", "", "Key file opening encrypted snapshots, see keygen")
 	}
 }
 
-var verbose bool
+// parseArgs parses the flags of cm wherever they come among args, leaving the
+// other arguments in cm.Args(). A "--" ends flags. Arguments from the first one
+// stop tells about are not parsed, they are returned as is.
+func parseArgs(cm *flag.FlagSet, args []string, stop func(string) bool) (rest []string) {
+	for i, a := range args {
+		if stop != nil && stop(a) {
+			args, rest = args[:i], args[i:]
+			break
+		}
+	}
+	var pos []string
+	for {
+		cm.Parse(args)
+		if cm.NArg() == 0 {
+			break
+		}
+		if n := len(args) - cm.NArg(); n > 0 && args[n-1] == "--" {
+			pos = append(pos, cm.Args()...)
+			break
+		}
+		pos = append(pos, cm.Arg(0))
+		args = cm.Args()[1:]
+	}
+	cm.Parse(append([]string{"--"}, pos...))
+	return rest
+}
+
+// queryFlags moves the flags of cm found within a query, as told by
+// internal.IsQueryToken, before it. Arguments of primaries are left alone,
+// even when they look like flags.
+func queryFlags(cm *flag.FlagSet, args []string) []string {
+	start := len(args)
+	for i, a := range args {
+		if internal.IsQueryToken(a) {
+			start = i
+			break
+		}
+	}
+	head := append([]string{}, args[:start]...)
+	var query []string
+	for i := start; i < len(args); i++ {
+		a := args[i]
+		if internal.IsQueryToken(a) {
+			query = append(query, a)
+			if internal.QueryTakesArg(a) && i+1 < len(args) {
+				i++
+				query = append(query, args[i])
+			}
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		if j := strings.IndexRune(name, '='); j >= 0 {
+			name = name[:j]
+		}
+		f := cm.Lookup(name)
+		if !strings.HasPrefix(a, "-") || f == nil {
+			query = append(query, a)
+			continue
+		}
+		head = append(head, a)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		if !strings.ContainsRune(a, '=') && i+1 < len(args) {
+			i++
+			head = append(head, args[i])
+		}
+	}
+	return append(head, query...)
+}
+
+// stringsFlag collects the values of a repeated flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var verbose, canonical, digest, indexed, encrypt, sign, requireSigned, force bool
+var asJSON, unchanged, rehash bool
+var recursive, long, showDups, interactive bool
+var order string
+var rollup int
+var overlap float64
+var depth int
+var compress, keyfile, catalogPath, extractPath, addr, remote string
+var findQuery []string
+var recipients, aliases, ins stringsFlag
 
 func main() {
 	setupCommonFlags()
@@ -81,15 +211,71 @@ func main() {
 	}
 
 	createCmd.BoolVar(&verbose, "verbose", false, "displays hashing speed")
+	createCmd.BoolVar(&canonical, "canonical", false, "sort nodes by path and store a content digest, the only part comparable across snapshots")
+	createCmd.BoolVar(&indexed, "index", false, "also build an index, see hsnap index")
+	createCmd.StringVar(&compress, "compress", "none", "compress snapshot with none, gzip or zstd")
+	convertCmd.StringVar(&compress, "compress", "none", "target compression, none, gzip or zstd")
+	mergeCmd.StringVar(&catalogPath, "o", "", "catalog file to write")
+	mergeCmd.StringVar(&compress, "compress", "none", "compress catalog with none, gzip or zstd")
+	mergeCmd.BoolVar(&encrypt, "encrypt", false, "encrypt with the HSNAP_PASSPHRASE passphrase")
+	mergeCmd.Var(&recipients, "recipient", "encrypt for a public key, or a file holding it, can be repeated")
+	mergeCmd.BoolVar(&sign, "sign", false, "sign the catalog with the key of the config directory")
+	extractCmd.StringVar(&extractPath, "o", "", "snapshot file to write")
+	extractCmd.StringVar(&compress, "compress", "none", "compress snapshot with none, gzip or zstd")
+	extractCmd.BoolVar(&encrypt, "encrypt", false, "encrypt with the HSNAP_PASSPHRASE passphrase")
+	extractCmd.Var(&recipients, "recipient", "encrypt for a public key, or a file holding it, can be repeated")
+	extractCmd.BoolVar(&sign, "sign", false, "sign the snapshot with the key of the config directory")
+	createCmd.BoolVar(&encrypt, "encrypt", false, "encrypt with the HSNAP_PASSPHRASE passphrase")
+	createCmd.Var(&recipients, "recipient", "encrypt for a public key, or a file holding it, can be repeated")
+	keygenCmd.StringVar(&keyfile, "o", "", "write the key to a file instead of printing it")
+	keygenCmd.BoolVar(&sign, "sign", false, "generate the signing key of the config directory instead")
+	createCmd.BoolVar(&sign, "sign", false, "sign the snapshot with the key of the config directory")
+	createCmd.StringVar(&remote, "remote", "", "snapshot a directory of another host over SFTP, as user@host:/path or ssh://user@host:port/path")
+	trimCmd.BoolVar(&force, "force", false, "trim even against truncated, corrupt or unverified snapshots")
+	trimCmd.BoolVar(&requireSigned, "require-signed", false, "refuse snapshots not signed by a trusted key")
+	dupCmd.BoolVar(&force, "force", false, "with -i, review even against truncated, corrupt or unverified snapshots")
+	dupCmd.BoolVar(&requireSigned, "require-signed", false, "with -i, refuse snapshots not signed by a trusted key")
+	createCmd.IntVar(&internal.WalkConcurrency, "walkers", internal.WalkConcurrency, "how many directories are listed concurrently")
+	infoCmd.BoolVar(&digest, "digest", false, "compute the content digest when not stored in the snapshot")
+	diffCmd.BoolVar(&asJSON, "json", false, "output changes as JSON")
+	diffCmd.BoolVar(&unchanged, "unchanged", false, "also list unchanged paths")
+	diffCmd.IntVar(&rollup, "rollup", 0, "sum up changes per directory, down to that depth")
+	statusCmd.BoolVar(&asJSON, "json", false, "output changes as JSON")
+	statusCmd.BoolVar(&unchanged, "unchanged", false, "also list unchanged paths")
+	statusCmd.IntVar(&rollup, "rollup", 0, "sum up changes per directory, down to that depth")
+	statusCmd.BoolVar(&rehash, "rehash", false, "compare file contents instead of modification times")
+	statusCmd.BoolVar(&verbose, "verbose", false, "displays hashing speed")
+	trimCmd.Float64Var(&overlap, "overlap", 0, "also report directories having that ratio of their bytes elsewhere, like 0.95")
+	trimCmd.Var(&aliases, "alias", "name a snapshot in reports, as NAME=FILE, can be repeated")
 	trimCmd.BoolVar(&delete, "delete", false, "really deletes stuff")
 	trimCmd.BoolVar(&quiet, "quiet", false, "do not list stuff")
+	dupCmd.BoolVar(&quiet, "quiet", false, "do not list stuff")
+	dupCmd.BoolVar(&interactive, "i", false, "review groups and pick local copies to delete")
+	trimCmd.BoolVar(&interactive, "i", false, "review groups and pick files to delete, instead of listing them")
+	duCmd.IntVar(&depth, "d", 1, "list subdirectories down to that depth")
+	findCmd.BoolVar(&asJSON, "json", false, "output matches as JSON")
+	serveCmd.StringVar(&addr, "addr", "localhost:8080", "address to listen on, like :8080 for all interfaces")
+	whichCmd.Var(&ins, "in", "snapshot to look files up in, a directory or a glob, can be repeated")
+	whichCmd.BoolVar(&verbose, "verbose", false, "displays hashing speed")
+	whichCmd.BoolVar(&quiet, "quiet", false, "only list files that are not found")
+	listCmd.BoolVar(&recursive, "R", false, "list subdirectories recursively")
+	listCmd.BoolVar(&long, "l", false, "long listing with mode, modification time and hash")
+	listCmd.BoolVar(&showDups, "dup", false, "mark files having duplicates within the snapshot")
+	listCmd.StringVar(&order, "sort", "name", "sort by name, size or time, directories first")
 
 	cm := subcommands[os.Args[1]]
 	if cm == nil {
 		log.Fatalf("Unknown subcommand '%s', see help for more details.", os.Args[1])
 	}
 
-	cm.Parse(os.Args[2:])
+	// find [SNAPSHOT...] QUERY, the query being no flags
+	args := os.Args[2:]
+	var stop func(string) bool
+	if cm == findCmd {
+		stop = internal.IsQueryToken
+		args = queryFlags(cm, args)
+	}
+	findQuery = parseArgs(cm, args, stop)
 
 	// Making sure wd and spath are properly set
 	if err := cleanwd(); err != nil {
@@ -105,12 +291,29 @@ func main() {
 	if spath == "" {
 		spath = filepath.Join(wd, internal.STATE_NAME)
 	}
+	if err := setupIdentities(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Main command switch
 	var err error
 	switch cm.Name() {
 
 	case createCmd.Name():
+		var comp internal.Compression
+		if comp, err = internal.ParseCompression(compress); err != nil {
+			break
+		}
+		var rs []internal.Recipient
+		if rs, err = parseRecipients(recipients, encrypt); err != nil {
+			break
+		}
+		var signer ed25519.PrivateKey
+		if sign {
+			if signer, err = readSigningKey(); err != nil {
+				break
+			}
+		}
 		var pbar io.Writer = io.Discard
 		if verbose {
 			pbar = bar.DefaultBytes(
@@ -118,7 +321,76 @@ func main() {
 				"Hashing",
 			)
 		}
-		err = create(pbar)
+		opt := internal.SnapshotOptions{
+			Canonical:   canonical,
+			Compression: comp,
+			Recipients:  rs,
+			Signer:      signer,
+		}
+		if remote == "" {
+			err = create(pbar, opt)
+			break
+		}
+		// Remote snapshots are named after their host, unless told otherwise
+		named := false
+		cm.Visit(func(f *flag.Flag) { named = named || f.Name == "hsnap" })
+		if !named {
+			_, host, _, _, _ := parseRemote(remote)
+			spath = filepath.Join(wd, host+".hsnap")
+		}
+		err = createRemote(remote, pbar, opt)
+
+	case mergeCmd.Name():
+		if catalogPath == "" || len(cm.Args()) == 0 {
+			err = fmt.Errorf("wrong usage, merge -o CATALOG SNAP...")
+			break
+		}
+		var opt internal.SnapshotOptions
+		if opt, err = writeOptions(); err != nil {
+			break
+		}
+		err = merge(catalogPath, opt, cm.Args()...)
+
+	case duCmd.Name():
+		err = du(filepath.Join(cm.Args()...))
+
+	case dupCmd.Name():
+		err = dup(cm.Args()...)
+
+	case findCmd.Name():
+		err = find(findQuery, cm.Args()...)
+
+	case serveCmd.Name():
+		err = serve(cm.Args()...)
+
+	case mountCmd.Name():
+		if cm.NArg() != 2 {
+			err = fmt.Errorf("wrong usage, mount SNAP DIR")
+			break
+		}
+		err = mount(cm.Arg(0), cm.Arg(1))
+
+	case whichCmd.Name():
+		if cm.NArg() == 0 {
+			err = fmt.Errorf("wrong usage, which FILE... -in SNAP")
+			break
+		}
+		var pbar io.Writer = io.Discard
+		if verbose {
+			pbar = bar.DefaultBytes(-1, "Hashing")
+		}
+		err = which(pbar, cm.Args()...)
+
+	case extractCmd.Name():
+		if extractPath == "" || cm.NArg() != 2 {
+			err = fmt.Errorf("wrong usage, extract SNAP PATH -o OUT")
+			break
+		}
+		var opt internal.SnapshotOptions
+		if opt, err = writeOptions(); err != nil {
+			break
+		}
+		err = extract(cm.Arg(0), cm.Arg(1), extractPath, opt)
 
 	case helpCmd.Name():
 		help()
@@ -129,15 +401,55 @@ func main() {
 	case checkCmd.Name():
 		err = check()
 
+	case indexCmd.Name():
+		err = index(cm.Args()...)
+
+	case convertCmd.Name():
+		var comp internal.Compression
+		if comp, err = internal.ParseCompression(compress); err != nil {
+			break
+		}
+		switch len(cm.Args()) {
+		case 1:
+			err = convert(comp, cm.Arg(0), "")
+		case 2:
+			err = convert(comp, cm.Arg(0), cm.Arg(1))
+		default:
+			err = fmt.Errorf("wrong usage, convert -compress=zstd SNAP [OUT]")
+		}
+
+	case keygenCmd.Name():
+		if sign {
+			err = signKeygen()
+		} else {
+			err = keygen(keyfile)
+		}
+
+	case verifyCmd.Name():
+		err = verifySig(cm.Args()...)
+
+	case errorsCmd.Name():
+		err = listErrors()
+
+	case diffCmd.Name():
+		if len(cm.Args()) != 2 {
+			err = fmt.Errorf("wrong usage, diff OLD.hsnap NEW.hsnap")
+			break
+		}
+		err = diff(cm.Arg(0), cm.Arg(1))
+
+	case statusCmd.Name():
+		var pbar io.Writer = io.Discard
+		if verbose && rehash {
+			pbar = bar.DefaultBytes(-1, "Hashing")
+		}
+		err = status(pbar, rehash)
+
 	case nodeCmd.Name():
 		err = node(cm.Args()...)
 
 	case listCmd.Name():
-		if len(cm.Args()) == 0 {
-			err = list("")
-		} else {
-			err = list(cm.Args()...)
-		}
+		err = list(cm.Args()...)
 
 	case trimCmd.Name():
 		if len(cm.Args()) == 0 {
@@ -164,11 +476,26 @@ func help() {
 
 These are common hsnap commands used in various situations:
 
-create    Make a snapshot for current working directory
+create    Make a snapshot for current working directory, or -remote over SFTP
 info      Basic information about current snapshot
 check     Existence of files in current snapshot
-trim      Remove local files that are present in provided snapshots
-list
+convert   Change the compression of a snapshot
+keygen    Generate a key pair for encrypted snapshots, or -sign for signing
+verify-sig  Check snapshots integrity and signature against trusted keys
+index     Build an index next to snapshots, speeding up ls and node
+errors    Files and directories that could not be read while snapshotting
+diff      Changes between two snapshots
+status    Changes of the working directory since its snapshot
+merge     Combine snapshots into a catalog, usable as any snapshot
+extract   Copy a directory of a snapshot into a snapshot of its own
+dup       Duplicated directories and files within snapshots
+du        Size of directories, largest first
+find      Files matching a query, across any number of snapshots
+which     Where local files are found in snapshots, by content
+serve     Browse snapshots from a web browser, read-only
+mount     Browse a snapshot as a read-only filesystem, files have no content
+trim      Remove local files that are present in provided snapshots, -i to review them
+ls        Content of snapshot directories, -R, -l, -sort and globs
 help      This help message
 `)
 	os.Exit(0)
@@ -190,14 +517,19 @@ func readTree(path string) (*internal.Tree, error) {
 	}
 	defer f.Close()
 
-	return internal.ReadTree(f)
+	return internal.ReadTree(f, identities...)
 }
 
-func create(spy io.Writer) error {
+func create(spy io.Writer, opt internal.SnapshotOptions) error {
 	if path, err := internal.LookupFrom(spath); path != "" || err != nil {
 		return fmt.Errorf("already a hsnap directory or child in %s: %s", path, err)
 	}
 
+	return snapshot(wd, spy, opt)
+}
+
+// snapshot root into a new spath
+func snapshot(root string, spy io.Writer, opt internal.SnapshotOptions) error {
 	f, err := os.OpenFile(spath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
 	if err != nil {
 		return err
@@ -206,10 +538,13 @@ func create(spy io.Writer) error {
 
 	start := time.Now()
 
-	c := internal.Snapshot(wd, f, spy)
+	c := internal.Snapshot(root, f, spy, opt)
 
 	fmt.Fprintf(output, "Encoded %d files in %s\n", c, time.Since(start))
 
+	if indexed {
+		return index(spath)
+	}
 	return nil
 }
 
@@ -230,8 +565,21 @@ func check() error {
 	return nil
 }
 
+func listErrors() error {
+	cur, err := readTree(spath)
+	if err != nil {
+		return err
+	}
+	failed := cur.Failed()
+	for _, n := range failed {
+		fmt.Fprintf(output, "%s: %s\n", n.Path(), n.Err)
+	}
+	fmt.Fprintf(output, "%d unreadable files\n", len(failed))
+	return nil
+}
+
 func info(paths ...string) error {
-	if paths == nil {
+	if len(paths) == 0 {
 		paths = []string{spath}
 	}
 	for _, x := range paths {
@@ -244,7 +592,8 @@ func info(paths ...string) error {
 	return nil
 }
 
-// info opens an hsnap, read its info header and counts how many nodes it has
+// info opens an hsnap, read its info header and footer. Snapshots without a
+// footer have all their nodes counted instead.
 // it does not check for sanity (like child has a valid parent and so on)
 func infoSingle(path string) error {
 	f, err := os.OpenFile(path, os.O_RDONLY, 0666)
@@ -253,173 +602,1429 @@ func infoSingle(path string) error {
 	}
 	defer f.Close()
 
-	dec := gob.NewDecoder(f)
+	encrypted, err := isEncrypted(path)
+	if err != nil {
+		return err
+	}
+
+	ft, err := internal.ReadFooter(f, identities...)
+	if errors.Is(err, internal.ErrEncrypted) {
+		fmt.Fprintf(output, "Encrypted, set HSNAP_PASSPHRASE or -identity to read it\n")
+		return nil
+	}
+	if err != nil && err != internal.ErrNoFooter {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dr, comp, err := internal.Decompress(f, identities...)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	dec := gob.NewDecoder(dr)
 
 	i := new(internal.Info)
 	if err = dec.Decode(i); err != nil {
 		return err
 	}
 	fmt.Fprintf(output, "%s\n", i)
+	if encrypted {
+		fmt.Fprintf(output, "Encrypted\n")
+	}
+	if comp != internal.CompressNone {
+		fmt.Fprintf(output, "Compressed with %s\n", comp)
+	}
+	if i.Canonical {
+		fmt.Fprintf(output, "Canonical node order\n")
+	}
+	if len(i.DerivedFrom) > 0 {
+		fmt.Fprintf(output, "Extracted from %s\n", i.DerivedFrom[0].String()[:8])
+	}
+	for _, src := range i.Sources {
+		fmt.Fprintf(output, "  %s created %s\n", &src.Info, src.CreatedAt.Format(time.RFC822))
+	}
 
 	// Cycle through all nodes
-	var size int64
-	var count int64
+	var t *internal.Tree
+	truncated := ft == nil && i.Version >= 2
+	if truncated {
+		fmt.Fprint(output, color.Red+"No footer, snapshot is truncated"+color.Reset+", counting what is left\n")
+	}
+	if ft == nil {
+		if digest {
+			t = internal.NewTree()
+			t.Info = i
+			ft = internal.NewFooter()
+			err = internal.DecodeNodes(dec, func(n *internal.Node) error {
+				ft.Account(n)
+				t.Add(n)
+				return nil
+			})
+		} else {
+			ft, err = internal.ScanFooter(dec)
+		}
+		if err != nil && !truncated {
+			return err
+		}
+	}
 
-	err = internal.DecodeNodes(dec, func(n *internal.Node) error {
-		if !n.Mode.IsDir() {
-			size = size + n.Size
-			count++
+	fmt.Fprintf(output, "Totalling %s and %d files\n", internal.ByteSize(ft.Bytes), ft.Files)
+	if ft.Duration > 0 {
+		fmt.Fprintf(output, "%d dirs, %d skipped, hashed in %s (%s/s)\n", ft.Dirs, ft.Skipped, ft.Duration.Round(time.Second), ft.Throughput())
+	}
+	if ft.Signed() {
+		fmt.Fprintf(output, "Signed by %s, see hsnap verify-sig\n", internal.FormatVerifyKey(ft.SignerKey))
+	}
+	if ft.Errors > 0 {
+		fmt.Fprintf(output, color.Red+"%d files unreadable"+color.Reset+", see hsnap errors\n", ft.Errors)
+	}
+
+	exts := make([]string, 0, len(ft.Extensions))
+	for x := range ft.Extensions {
+		exts = append(exts, x)
+	}
+	sort.Slice(exts, func(a, b int) bool {
+		if ca, cb := ft.Extensions[exts[a]], ft.Extensions[exts[b]]; ca != cb {
+			return ca > cb
 		}
-		return nil
+		return exts[a] < exts[b]
 	})
-	if err != nil {
-		return err
+	if len(exts) > 5 {
+		exts = exts[:5]
+	}
+	for _, x := range exts {
+		name := x
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(output, "\t%s\t%d files\n", name, ft.Extensions[x])
 	}
 
-	fmt.Fprintf(output, "Totalling %s and %d files\n", internal.ByteSize(size), count)
+	switch {
+	case ft.Digest != nil:
+		fmt.Fprintf(output, "Digest %x\n", ft.Digest)
+	case digest:
+		if t == nil {
+			if t, err = readTree(path); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(output, "Digest %x\n", t.Digest())
+	}
 	return nil
 }
 
-func list(paths ...string) error {
-	cur, err := readTree(spath)
-	if err != nil {
-		return err
-	}
-	path := filepath.Join(paths...)
-	var at *internal.Node
-	if path == "" {
-		at = cur.Root()
-	} else {
-		at = cur.Search(path)
+// list nodes matching patterns, directories having their content listed,
+// like ls does. The index is used when there is one.
+func list(patterns ...string) error {
+	by := internal.ListOrder(order)
+	switch by {
+	case internal.ByName, internal.BySize, internal.ByTime:
+	default:
+		return fmt.Errorf("unknown sort order %s, use name, size or time", order)
 	}
-	if at == nil {
-		fmt.Fprintf(output, "Not found\n")
-		return nil
+	if len(patterns) == 0 {
+		patterns = []string{""}
 	}
 
-	w := new(tabwriter.Writer)
+	var l internal.Lister
+	if x := openIndex(spath); x != nil {
+		defer x.Close()
+		l = x
+	} else {
+		cur, err := readTree(spath)
+		if err != nil {
+			return err
+		}
+		l = internal.TreeLister(cur)
+	}
 
-	w.Init(output, 5, 4, 1, '\t', tabwriter.AlignRight)
-	children := cur.ChildrenOf(at)
+	var files, dirs []internal.Entry
+	for _, p := range patterns {
+		es, err := internal.Glob(l, p)
+		if err != nil {
+			return err
+		}
+		if len(es) == 0 {
+			return fmt.Errorf("%s not found", p)
+		}
+		for _, e := range es {
+			if e.Node.Mode.IsDir() {
+				dirs = append(dirs, e)
+			} else {
+				files = append(files, e)
+			}
+		}
+	}
 
-	// Sort per size, then per name
-	// Folders on top
+	internal.SortListing(files, by)
+	if err := listNodes(l, files, true); err != nil {
+		return err
+	}
+	titled := len(files) > 0 || len(dirs) > 1 || recursive
+	for len(dirs) > 0 {
+		d := dirs[0]
+		dirs = dirs[1:]
+		cs, err := l.ChildrenOf(d.Path)
+		if err != nil {
+			return err
+		}
+		internal.SortListing(cs, by)
+		if titled {
+			title := d.Path
+			if title == "" {
+				title = "."
+			}
+			fmt.Fprintf(output, color.Blue+"%s:"+color.Reset+"\n", title)
+		}
+		if err := listNodes(l, cs, false); err != nil {
+			return err
+		}
+		if recursive {
+			var subs []internal.Entry
+			for _, c := range cs {
+				if c.Node.Mode.IsDir() {
+					subs = append(subs, c)
+				}
+			}
+			dirs = append(subs, dirs...)
+		}
+	}
+	return nil
+}
 
-	for _, x := range children {
-		d := " "
+// listNodes prints a line per node, sizing directories after their content.
+// Nodes are named by their relative path when full is set.
+func listNodes(l internal.Lister, es []internal.Entry, full bool) error {
+	w := tabwriter.NewWriter(output, 5, 4, 1, ' ', tabwriter.AlignRight)
+	for _, e := range es {
+		x := e.Node
+		name, files := x.Name, ""
+		if full {
+			name = e.Path
+		}
 		if x.Mode.IsDir() {
-			d = "d"
+			name, files = name+"/", fmt.Sprintf("%d files", e.Stats.Files)
+		}
+		if long {
+			mtime, hash := "-", "-"
+			if !x.ModTime.IsZero() {
+				mtime = x.ModTime.Local().Format("2006-01-02 15:04")
+			}
+			if x.Failed() {
+				hash = "unreadable"
+			} else if !x.Mode.IsDir() {
+				hash = fmt.Sprintf("%x", x.Hash[:4])
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t", x.Mode, internal.ByteSize(e.Size()), files, mtime, hash)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t", internal.ByteSize(e.Size()), files)
+		}
+		if showDups {
+			c, err := l.Dups(x)
+			if err != nil {
+				return err
+			}
+			dup := ""
+			if c > 0 {
+				dup = fmt.Sprintf("+%d dup", c)
+			}
+			fmt.Fprintf(w, "%s\t", dup)
 		}
-		fmt.Fprintf(w, "%s%d(%d)\t%s\t%s\n", d, x.ID, x.ParentID, internal.ByteSize(x.Size), x.Name)
+		fmt.Fprintf(w, " %s\n", name)
 	}
+	return w.Flush()
+}
 
-	w.Flush()
-
-	return nil
+// readTrimTree reads a snapshot trim can rely on. Anything but a complete
+// snapshot is refused, unless forced.
+func readTrimTree(path string) (*internal.Tree, error) {
+	t, err := readTree(path)
+	switch {
+	case t == nil || (err != nil && t.Integrity == internal.Unverified):
+		return nil, err
+	case t.Integrity == internal.Complete:
+		return t, nil
+	case !force && err != nil:
+		return nil, fmt.Errorf("%s: %w, use -force to trim with what could be read", path, err)
+	case !force:
+		return nil, fmt.Errorf("%s: snapshot predates integrity checks, recreate it or use -force", path)
+	}
+	fmt.Fprintf(output, color.Yellow+"%s is %s, trimming with what could be read\n"+color.Reset, path, t.Integrity)
+	return t, nil
 }
 
-func trim(delete bool, withs ...string) error {
+// du lists directories below path, largest first
+func du(path string) error {
 	cur, err := readTree(spath)
 	if err != nil {
 		return err
 	}
-	cur.Name = "a"
-	fmt.Fprintf(output, color.Red+"%s %s (%s)\n"+color.Reset, cur.Name, cur.Info, spath)
+	at := cur.Search(path)
+	if at == nil {
+		return fmt.Errorf("%s not found", path)
+	}
+	if !at.Mode.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	w := tabwriter.NewWriter(output, 5, 4, 1, ' ', tabwriter.AlignRight)
+	for _, u := range cur.Usage(at, depth) {
+		fmt.Fprintf(w, "%s\t%d files\t %s/\n", internal.ByteSize(u.Bytes), u.Files, u.Path)
+	}
+	return w.Flush()
+}
 
-	cur.Info.RootPath = wd
+// found is a find match, as output in JSON
+type found struct {
+	Snapshot string     `json:"snapshot"`
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	ModTime  *time.Time `json:"mtime,omitempty"`
+	Hash     string     `json:"hash,omitempty"`
+	Dir      bool       `json:"dir,omitempty"`
+}
+
+// find lists the nodes of snapshots matching query
+func find(query []string, paths ...string) error {
+	if len(paths) == 0 {
+		paths = []string{spath}
+	}
+	paths, err := expandSnapshots(paths)
+	if err != nil {
+		return err
+	}
+	q, err := internal.ParseQuery(query, readTree)
+	if err != nil {
+		return err
+	}
 
 	var trees []*internal.Tree
-	for k, w := range withs {
-		x, err := readTree(w)
+	for _, path := range paths {
+		t, err := readTree(path)
 		if err != nil {
-			return err
+			return fmt.Errorf("%s: %w", path, err)
 		}
-		trees = append(trees, x)
-		x.Name = string("bcdefghijkl"[k])
-		fmt.Fprintf(output, color.Green+"%s %s (%s)\n"+color.Reset, x.Name, x.Info, w)
-	}
-
-	matches := cur.Trim(trees...)
-	tots := len(matches)
-	dels := matches.PruneSingleTreeGroups()
-	fmt.Fprintf(output, "%d file groups\n", tots)
-	for t, v := range dels {
-		fmt.Fprintf(output, "%s had %d specific files not found elsewhere\n", t.Name, v)
+		if dup := overlapping(trees, t); dup != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s, already part of %s\n", path, treeLabel(dup))
+			continue
+		}
+		trees = append(trees, t)
 	}
 
-	var count, errc int
-	var groups int
-	var waste int64
-
-	if delete {
-		for _, ma := range matches {
-			in, _ := internal.SplitNodes(cur, ma)
-
-			groups++
-
-			for _, n := range in {
-				p := n.Tree().AbsPath(n)
-				if err := os.Remove(p); err != nil {
-					fmt.Fprintf(output, "Cannot remove %s: %s\n", p, err)
-					errc++
+	matches := []found{}
+	for _, t := range trees {
+		for _, n := range t.Find(q) {
+			if !asJSON {
+				if len(trees) > 1 {
+					fmt.Fprintln(output, nodeLabel(n))
 				} else {
-					fmt.Fprintf(output, "Removed %s\n", p)
-					count++
-					waste = waste + int64(internal.Nodes(in).ByteSize())
+					fmt.Fprintln(output, n.Path())
 				}
-			}
-		}
-		fmt.Fprintf(output, "%d duplicated groups, removed %d files totalling %s wasted space, %d errors\n", groups, count, internal.ByteSize(waste), errc)
-	} else {
-		for _, ma := range matches {
-			var str strings.Builder
-			in, out := internal.SplitNodes(cur, ma)
-
-			count = count + len(in)
-			bs := internal.Nodes(in).ByteSize()
-			waste = waste + int64(bs)
-			groups++
-			if quiet {
 				continue
 			}
-			str.WriteString(fmt.Sprintf("%d files (wasting %s)\n", len(in), bs))
-
-			for _, n := range in {
-				str.WriteString(fmt.Sprintf(color.Red+"\t-%s %s\n"+color.Reset, n.Tree().Name, n.Path()))
+			f := found{Snapshot: treeLabel(t), Path: n.Path(), Size: n.Size, Dir: n.Mode.IsDir()}
+			if !n.ModTime.IsZero() {
+				f.ModTime = &n.ModTime
 			}
-			for _, n := range out {
-				str.WriteString(fmt.Sprintf(color.Green+"\t+%s %s\n"+color.Reset, n.Tree().Name, n.Path()))
+			if src := t.Source(n); src != nil {
+				f.Snapshot = src.Hostname + ":" + src.RootPath
 			}
-
-			fmt.Fprintln(output, str.String())
+			if !f.Dir && !n.Failed() {
+				f.Hash = hex.EncodeToString(n.Hash[:])
+			}
+			matches = append(matches, f)
 		}
-		fmt.Fprintf(output, "%d duplicated groups, totalling %s wasted space in %d files\n", groups, internal.ByteSize(waste), count)
 	}
-
-	if errc != 0 {
-		return errors.New("Delete got some errors while processing")
+	if asJSON {
+		enc := json.NewEncoder(output)
+		enc.SetIndent("", "  ")
+		return enc.Encode(matches)
 	}
-
 	return nil
 }
 
-func node(ids ...string) error {
-	cur, err := readTree(spath)
+// which looks local files up in snapshots, failing when one is not found
+func which(spy io.Writer, files ...string) error {
+	if len(ins) == 0 {
+		ins = stringsFlag{spath}
+	}
+	paths, err := expandSnapshots(ins)
 	if err != nil {
 		return err
 	}
-
-	for _, id := range ids {
-		i, err := strconv.Atoi(id)
+	var trees []*internal.Tree
+	for _, path := range paths {
+		t, err := readTree(path)
 		if err != nil {
-			return err
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		trees = append(trees, t)
+	}
+
+	ls, err := internal.Which(files, spy, trees...)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, l := range ls {
+		switch {
+		case l.Node.Failed():
+			missing++
+			fmt.Fprintf(output, color.Red+"%s: %s\n"+color.Reset, l.Path, l.Node.Err)
+		case len(l.Matches) == 0:
+			missing++
+			fmt.Fprintf(output, color.Red+"%s: not found\n"+color.Reset, l.Path)
+		case !quiet:
+			fmt.Fprintf(output, color.Green+"%s\n"+color.Reset, l.Path)
+			for _, m := range l.Matches {
+				fmt.Fprintf(output, "  %s\n", nodeLabel(m))
+			}
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d files not found", missing, len(ls))
+	}
+	return nil
+}
+
+// serve snapshots over HTTP until interrupted
+func serve(paths ...string) error {
+	if len(paths) == 0 {
+		paths = []string{spath}
+	}
+	paths, err := expandSnapshots(paths)
+	if err != nil {
+		return err
+	}
+	var trees []*internal.Tree
+	for _, path := range paths {
+		t, err := readTree(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		t.Name = path
+		trees = append(trees, t)
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           internal.NewServer(trees...),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Fprintf(output, "Serving %d snapshots on http://%s/\n", len(trees), addr)
+	return srv.ListenAndServe()
+}
+
+// mount serves a snapshot read-only on dir until interrupted
+func mount(path, dir string) error {
+	t, err := readTree(path)
+	if err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		if err := internal.Unmount(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot unmount %s: %s\n", dir, err)
+		}
+	}()
+	fmt.Fprintf(output, "Mounting %s on %s, interrupt to unmount\n", path, dir)
+	return internal.Mount(t, dir)
+}
+
+// dup lists duplicates within snapshots, whole directories first
+func dup(paths ...string) error {
+	// Reviewing deletes copies of the working directory, its snapshot comes
+	// first, and every snapshot is checked as trim does
+	if interactive {
+		paths = append([]string{spath}, paths...)
+	} else if len(paths) == 0 {
+		paths = []string{spath}
+	}
+	paths, err := expandSnapshots(paths)
+	if err != nil {
+		return err
+	}
+	var trusted []internal.TrustedKey
+	if interactive && requireSigned {
+		if trusted, err = readTrustedKeys(); err != nil {
+			return err
+		}
+	}
+	var trees []*internal.Tree
+	for i, path := range paths {
+		var t *internal.Tree
+		if !interactive {
+			if t, err = readTree(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		} else if i == 0 {
+			if t, err = readTrimTree(path); err != nil {
+				return err
+			}
+		} else {
+			// Copies get deleted on the word of the others, they are held
+			// to the same checks as with trim
+			if absPath(path) == absPath(spath) {
+				continue
+			}
+			if t, err = readTrimTree(path); err != nil {
+				return err
+			}
+			if trees[0].Overlaps(t) {
+				return fmt.Errorf("%s includes the snapshot being reviewed", path)
+			}
+			if requireSigned {
+				if _, err := t.Footer.Verify(trusted); err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+			}
+		}
+		if dup := overlapping(trees, t); dup != nil {
+			fmt.Fprintf(output, "Skipping %s, already part of %s\n", path, treeLabel(dup))
+			continue
+		}
+		trees = append(trees, t)
+	}
+
+	if interactive {
+		local := trees[0]
+		if local.Info.IsCatalog() {
+			return fmt.Errorf("%s is a catalog, it cannot be reviewed", spath)
+		}
+		local.Info.RootPath = wd
+		return review(internal.DupReview(local, trees[1:]...))
+	}
+
+	var waste int64
+	var count int
+	var dirs internal.Nodes
+	dgs := internal.DupDirs(trees...)
+	for _, g := range dgs {
+		st := g[0].Tree().DirStats(g[0])
+		waste += st.Bytes * int64(len(g)-1)
+		count += int(st.Files) * (len(g) - 1)
+		dirs = append(dirs, g...)
+		if quiet {
+			continue
+		}
+		fmt.Fprintf(output, "%d directories of %d files (wasting %s)\n", len(g), st.Files, internal.ByteSize(st.Bytes*int64(len(g)-1)))
+		for _, n := range g {
+			fmt.Fprintf(output, "\t%s/\n", nodeLabel(n))
+		}
+		fmt.Fprintln(output)
+	}
+
+	inDirs := internal.Below(dirs)
+	matches := make(internal.HashGroup)
+	for _, t := range trees {
+		t.Walk(func(_ string, n *internal.Node) error {
+			matches.Add(n)
+			return nil
+		})
+	}
+	var groups int
+	for _, g := range matches {
+		var rest internal.Nodes
+		for _, n := range g {
+			if !inDirs[n] {
+				rest = append(rest, n)
+			}
+		}
+		// Groups within duplicate directories only are already reported
+		if len(g) < 2 || len(rest) == 0 {
+			continue
+		}
+		groups++
+		count += len(g) - 1
+		waste += g[0].Size * int64(len(g)-1)
+		if quiet {
+			continue
+		}
+		fmt.Fprintf(output, "%d files (wasting %s)\n", len(g), internal.ByteSize(g[0].Size*int64(len(g)-1)))
+		for _, n := range g {
+			fmt.Fprintf(output, "\t%s\n", nodeLabel(n))
+		}
+		fmt.Fprintln(output)
+	}
+	fmt.Fprintf(output, "%d duplicated directories and %d duplicated groups, totalling %s wasted space in %d files\n", len(dgs), groups, internal.ByteSize(waste), count)
+	return nil
+}
+
+// removeDir removes the files of a snapshotted directory, then the directory
+// itself and its subdirectories when they end up empty. Files created since
+// the snapshot are kept, and so are their directories. Freed is the size of
+// the files actually removed.
+func removeDir(d *internal.Node) (count, errc int, freed int64) {
+	t := d.Tree()
+	var dirs internal.Nodes
+	t.WalkFrom(d, func(_ string, n *internal.Node) error {
+		if n.Mode.IsDir() {
+			dirs = append(dirs, n)
+			return nil
+		}
+		p := t.AbsPath(n)
+		if err := os.Remove(p); err != nil {
+			fmt.Fprintf(output, "Cannot remove %s: %s\n", p, err)
+			errc++
+		} else {
+			count++
+			freed += n.Size
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := t.AbsPath(dirs[i])
+		if err := os.Remove(p); err != nil {
+			fmt.Fprintf(output, "Kept %s: %s\n", p, err)
+		}
+	}
+	fmt.Fprintf(output, "Removed %s, %d files\n", t.AbsPath(d), count)
+	return
+}
+
+// parseAliases of -alias NAME=FILE flags, by absolute file path
+func parseAliases(as []string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, a := range as {
+		name, path, ok := strings.Cut(a, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("bad alias %q, use NAME=FILE", a)
+		}
+		names[absPath(path)] = name
+	}
+	return names, nil
+}
+
+// expandSnapshots replaces directories by the snapshots they hold, and globs
+// by their matches, keeping each file once
+func expandSnapshots(args []string) (paths []string, err error) {
+	seen := make(map[string]bool)
+	add := func(ps ...string) {
+		for _, p := range ps {
+			if p = filepath.Clean(p); !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	for _, arg := range args {
+		var ms []string
+		if st, err := os.Stat(arg); err == nil && st.IsDir() {
+			ms, err = filepath.Glob(filepath.Join(arg, "*.hsnap"))
+			if err != nil {
+				return nil, err
+			}
+		} else if strings.ContainsAny(arg, "*?[") {
+			if ms, err = filepath.Glob(arg); err != nil {
+				return nil, err
+			}
+		} else {
+			add(arg)
+			continue
+		}
+		if len(ms) == 0 {
+			return nil, fmt.Errorf("no snapshot found in %s", arg)
+		}
+		add(ms...)
+	}
+	return
+}
+
+// treeLabel names a tree in reports, by its alias or its host and root
+func treeLabel(t *internal.Tree) string {
+	switch {
+	case t.Name != "":
+		return t.Name
+	case t.Info.IsCatalog():
+		return t.Info.String()
+	}
+	return t.Info.Hostname + ":" + t.Info.RootPath
+}
+
+// treeHeader introduces a tree in reports
+func treeHeader(t *internal.Tree, path string) string {
+	if t.Name != "" {
+		return fmt.Sprintf("%s %s (%s)", t.Name, t.Info, path)
+	}
+	return fmt.Sprintf("%s (%s)", t.Info, path)
+}
+
+// overlapping returns the first of ts sharing a snapshot with t
+func overlapping(ts []*internal.Tree, t *internal.Tree) *internal.Tree {
+	for _, x := range ts {
+		if x.Overlaps(t) {
+			return x
+		}
+	}
+	return nil
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// nodeLabel shows a node in reports, as host:path or after the alias of its
+// tree
+func nodeLabel(n *internal.Node) string {
+	t := n.Tree()
+	if t.Name != "" {
+		return t.Name + " " + n.Path()
+	}
+	host := t.Info.Hostname
+	if src := t.Source(n); src != nil {
+		host = src.Hostname
+	}
+	return host + ":" + n.Path()
+}
+
+func trim(delete bool, withs ...string) error {
+	cur, err := readTrimTree(spath)
+	if err != nil {
+		return err
+	}
+	if cur.Info.IsCatalog() {
+		return fmt.Errorf("%s is a catalog, it can only be trimmed against", spath)
+	}
+	names, err := parseAliases(aliases)
+	if err != nil {
+		return err
+	}
+	if withs, err = expandSnapshots(withs); err != nil {
+		return err
+	}
+	cur.Name = names[absPath(spath)]
+	fmt.Fprintf(output, color.Red+"%s\n"+color.Reset, treeHeader(cur, spath))
+
+	cur.Info.RootPath = wd
+
+	var trusted []internal.TrustedKey
+	if requireSigned {
+		if trusted, err = readTrustedKeys(); err != nil {
+			return err
+		}
+	}
+
+	var trees []*internal.Tree
+	for _, w := range withs {
+		if absPath(w) == absPath(spath) {
+			continue
+		}
+		x, err := readTrimTree(w)
+		if err != nil {
+			return err
+		}
+		if cur.Overlaps(x) {
+			return fmt.Errorf("%s includes the snapshot being trimmed", w)
+		}
+		if requireSigned {
+			if _, err := x.Footer.Verify(trusted); err != nil {
+				return fmt.Errorf("%s: %w", w, err)
+			}
+		}
+		if dup := overlapping(trees, x); dup != nil {
+			fmt.Fprintf(output, "Skipping %s, already part of %s\n", w, treeLabel(dup))
+			continue
+		}
+		trees = append(trees, x)
+		x.Name = names[absPath(w)]
+		fmt.Fprintf(output, color.Green+"%s\n"+color.Reset, treeHeader(x, w))
+	}
+
+	if interactive {
+		return review(internal.TrimReview(cur, trees...))
+	}
+
+	matches := cur.Trim(trees...)
+	tots := len(matches)
+	dels := matches.PruneSingleTreeGroups()
+	fmt.Fprintf(output, "%d file groups\n", tots)
+	for t, v := range dels {
+		fmt.Fprintf(output, "%s had %d specific files not found elsewhere\n", treeLabel(t), v)
+	}
+
+	// Whole directories found elsewhere come first, their files are not
+	// listed a second time
+	dms := cur.TrimDirs(trees...)
+	var dupDirs internal.Nodes
+	for _, dm := range dms {
+		dupDirs = append(dupDirs, dm.Dir)
+	}
+	inDupDirs := internal.Below(dupDirs)
+
+	var count, errc int
+	var groups int
+	var waste int64
+
+	if delete {
+		for _, dm := range dms {
+			c, e, f := removeDir(dm.Dir)
+			count, errc, waste = count+c, errc+e, waste+f
+		}
+		for _, ma := range matches {
+			in, _ := internal.SplitNodes(cur, ma)
+			var rest internal.Nodes
+			for _, n := range in {
+				if !inDupDirs[n] {
+					rest = append(rest, n)
+				}
+			}
+			if len(rest) == 0 {
+				continue
+			}
+
+			groups++
+
+			for _, n := range rest {
+				p := n.Tree().AbsPath(n)
+				if err := os.Remove(p); err != nil {
+					fmt.Fprintf(output, "Cannot remove %s: %s\n", p, err)
+					errc++
+				} else {
+					fmt.Fprintf(output, "Removed %s\n", p)
+					count++
+					waste += n.Size
+				}
+			}
+		}
+		fmt.Fprintf(output, "%d duplicated directories and %d duplicated groups, removed %d files totalling %s wasted space, %d errors\n", len(dms), groups, count, internal.ByteSize(waste), errc)
+	} else {
+		var dirFiles int64
+		for _, dm := range dms {
+			st := cur.DirStats(dm.Dir)
+			dirFiles += st.Files
+			waste += st.Bytes
+			if quiet {
+				continue
+			}
+			var str strings.Builder
+			str.WriteString(fmt.Sprintf("Directory of %d files (wasting %s)\n", st.Files, internal.ByteSize(st.Bytes)))
+			str.WriteString(fmt.Sprintf(color.Red+"\t-%s/\n"+color.Reset, nodeLabel(dm.Dir)))
+			for _, n := range dm.Others {
+				str.WriteString(fmt.Sprintf(color.Green+"\t+%s/\n"+color.Reset, nodeLabel(n)))
+			}
+			fmt.Fprintln(output, str.String())
+		}
+
+		for _, ma := range matches {
+			var str strings.Builder
+			in, out := internal.SplitNodes(cur, ma)
+			var rest internal.Nodes
+			for _, n := range in {
+				if !inDupDirs[n] {
+					rest = append(rest, n)
+				}
+			}
+			if len(rest) == 0 {
+				continue
+			}
+			in = rest
+
+			count = count + len(in)
+			bs := internal.Nodes(in).ByteSize()
+			waste = waste + int64(bs)
+			groups++
+			if quiet {
+				continue
+			}
+			str.WriteString(fmt.Sprintf("%d files (wasting %s)\n", len(in), bs))
+
+			for _, n := range in {
+				str.WriteString(fmt.Sprintf(color.Red+"\t-%s\n"+color.Reset, nodeLabel(n)))
+			}
+			for _, n := range out {
+				str.WriteString(fmt.Sprintf(color.Green+"\t+%s\n"+color.Reset, nodeLabel(n)))
+			}
+
+			fmt.Fprintln(output, str.String())
+		}
+		fmt.Fprintf(output, "%d duplicated directories and %d duplicated groups, totalling %s wasted space in %d files\n", len(dms), groups, internal.ByteSize(waste), count+int(dirFiles))
+	}
+
+	if overlap > 0 {
+		for _, o := range cur.DirOverlaps(matches, overlap, dupDirs) {
+			fmt.Fprintf(output, color.Yellow+"%s/ is %.0f%% elsewhere"+color.Reset+", %s of %s, %d of its %d files\n",
+				o.Dir.Path(), 100*o.Ratio(), internal.ByteSize(o.Contained.Bytes), internal.ByteSize(o.Total.Bytes), o.Contained.Files, o.Total.Files)
+		}
+	}
+
+	if errc != 0 {
+		return errors.New("Delete got some errors while processing")
+	}
+
+	return nil
+}
+
+// writeOptions of snapshots derived from others, from -compress, -encrypt,
+// -recipient and -sign
+func writeOptions() (opt internal.SnapshotOptions, err error) {
+	if opt.Compression, err = internal.ParseCompression(compress); err != nil {
+		return
+	}
+	if opt.Recipients, err = parseRecipients(recipients, encrypt); err != nil {
+		return
+	}
+	if sign {
+		opt.Signer, err = readSigningKey()
+	}
+	return
+}
+
+// writeNew creates the file at path, which must not exist, and fills it with
+// write. The file is removed if write fails.
+func writeNew(path string, write func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = write(w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// merge snapshots into a new catalog file
+func merge(out string, opt internal.SnapshotOptions, paths ...string) error {
+	var trees []*internal.Tree
+	for _, path := range paths {
+		t, err := readTree(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		trees = append(trees, t)
+	}
+
+	err := writeNew(out, func(w io.Writer) error {
+		return internal.Merge(w, opt, trees...)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Merged %d snapshots into %s\n", len(trees), out)
+	return nil
+}
+
+// extract the directory at path of a snapshot into a new one
+func extract(from, path, out string, opt internal.SnapshotOptions) error {
+	t, err := readTree(from)
+	if err != nil {
+		return err
+	}
+	err = writeNew(out, func(w io.Writer) error {
+		return internal.Extract(t, path, w, opt)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	x, err := readInfo(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Extracted %s into %s\n", x, out)
+	return nil
+}
+
+func diff(from, to string) error {
+	a, err := readTree(from)
+	if err != nil {
+		return fmt.Errorf("%s: %w", from, err)
+	}
+	b, err := readTree(to)
+	if err != nil {
+		return fmt.Errorf("%s: %w", to, err)
+	}
+	if !asJSON {
+		fmt.Fprintf(output, color.Red+"- %s (%s)\n"+color.Reset, a.Info, from)
+		fmt.Fprintf(output, color.Green+"+ %s (%s)\n"+color.Reset, b.Info, to)
+	}
+	return printDiff(internal.DiffTrees(a, b))
+}
+
+// status compares the snapshot to the working directory
+func status(spy io.Writer, rehash bool) error {
+	cur, err := readTree(spath)
+	if err != nil {
+		return err
+	}
+	if !asJSON {
+		fmt.Fprintf(output, "On %s (%s), compared to %s\n", cur.Info, spath, wd)
+	}
+	d, err := cur.Status(wd, spy, rehash)
+	if err != nil {
+		return err
+	}
+	if err := printDiff(d); err != nil || asJSON {
+		return err
+	}
+	if len(d.Changes) == d.Totals[internal.Unchanged].Count {
+		fmt.Fprint(output, color.Green+"Snapshot is up to date\n"+color.Reset)
+	} else {
+		fmt.Fprint(output, color.Yellow+"Snapshot is outdated, create it again before trimming against it\n"+color.Reset)
+	}
+	return nil
+}
+
+// printDiff according to -json, -rollup and -unchanged
+func printDiff(d *internal.Diff) error {
+	if asJSON {
+		enc := json.NewEncoder(output)
+		enc.SetIndent("", "  ")
+		if rollup > 0 {
+			return enc.Encode(struct {
+				Dirs   []internal.DirChanges                      `json:"dirs"`
+				Totals map[internal.ChangeKind]internal.DiffTotal `json:"totals"`
+			}{d.Rollup(rollup), d.Totals})
+		}
+		if !unchanged {
+			cs := d.Changes[:0:0]
+			for _, c := range d.Changes {
+				if c.Kind != internal.Unchanged {
+					cs = append(cs, c)
+				}
+			}
+			d = &internal.Diff{Changes: cs, Totals: d.Totals}
+		}
+		return enc.Encode(d)
+	}
+
+	totals := func(ts map[internal.ChangeKind]internal.DiffTotal) string {
+		var parts []string
+		for _, k := range internal.ChangeKinds {
+			if t, ok := ts[k]; ok {
+				parts = append(parts, fmt.Sprintf("%d %s (%s)", t.Count, k, internal.ByteSize(t.Bytes)))
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	if rollup > 0 {
+		w := tabwriter.NewWriter(output, 5, 4, 1, ' ', 0)
+		for _, dc := range d.Rollup(rollup) {
+			fmt.Fprintf(w, "%s/\t%s\n", dc.Dir, totals(dc.Totals))
+		}
+		w.Flush()
+	} else {
+		for _, c := range d.Changes {
+			path := c.Path
+			if c.Dir {
+				path += "/"
+			}
+			switch c.Kind {
+			case internal.Added:
+				fmt.Fprintf(output, color.Green+"+ %s"+color.Reset+" %s\n", path, internal.ByteSize(c.Size))
+			case internal.Removed:
+				fmt.Fprintf(output, color.Red+"- %s"+color.Reset+" %s\n", path, internal.ByteSize(c.Size))
+			case internal.Modified:
+				fmt.Fprintf(output, color.Yellow+"~ %s"+color.Reset+" %s -> %s (%s)\n", path, internal.ByteSize(c.OldSize), internal.ByteSize(c.Size), c.Reason)
+			case internal.Moved:
+				fmt.Fprintf(output, color.Cyan+"> %s -> %s"+color.Reset+" %s\n", c.OldPath, path, internal.ByteSize(c.Size))
+			case internal.Unchanged:
+				if unchanged {
+					fmt.Fprintf(output, "  %s\n", path)
+				}
+			}
+		}
+	}
+	fmt.Fprintln(output, totals(d.Totals))
+	return nil
+}
+
+func node(ids ...string) error {
+	var lookup func(id int) (*internal.Node, string, error)
+	if x := openIndex(spath); x != nil {
+		defer x.Close()
+		lookup = func(id int) (*internal.Node, string, error) {
+			np, err := x.Node(id)
+			return np.Node, np.Path, err
+		}
+	} else {
+		cur, err := readTree(spath)
+		if err != nil {
+			return err
+		}
+		lookup = func(id int) (*internal.Node, string, error) {
+			n := cur.Node(id)
+			if n == nil {
+				return nil, "", nil
+			}
+			return n, cur.RelPath(n), nil
+		}
+	}
+
+	for _, id := range ids {
+		i, err := strconv.Atoi(id)
+		if err != nil {
+			return err
+		}
+		n, path, err := lookup(i)
+		if err != nil {
+			return err
 		}
-		n := cur.Node(i)
 		if n == nil {
 			fmt.Fprintf(output, "%s not found\n", id)
 		} else {
-			fmt.Fprintf(output, "%s %s\n", n, cur.RelPath(n))
+			fmt.Fprintf(output, "%s %s\n", n, path)
+		}
+	}
+	return nil
+}
+
+// configDir holds the signing key (signing.key) and the public keys trusted
+// when verifying signatures (trusted_keys). HSNAP_CONFIG overrides it.
+func configDir() (string, error) {
+	if d := os.Getenv("HSNAP_CONFIG"); d != "" {
+		return d, nil
+	}
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "hsnap"), nil
+}
+
+func readSigningKey() (ed25519.PrivateKey, error) {
+	d, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	return internal.ReadSigningKeyFile(filepath.Join(d, "signing.key"))
+}
+
+// readTrustedKeys of the config directory, none when the file is missing
+func readTrustedKeys() ([]internal.TrustedKey, error) {
+	d, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	ts, err := internal.ReadTrustedKeys(filepath.Join(d, "trusted_keys"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return ts, err
+}
+
+// signKeygen creates the signing key of the config directory, and trusts it
+func signKeygen() error {
+	d, err := configDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d, 0700); err != nil {
+		return err
+	}
+	k, err := internal.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	pub := internal.FormatVerifyKey(k.Public().(ed25519.PublicKey))
+
+	f, err := os.OpenFile(filepath.Join(d, "signing.key"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "# public key: %s\n%s\n", pub, internal.FormatSigningKey(k))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	hs, _ := os.Hostname()
+	f, err = os.OpenFile(filepath.Join(d, "trusted_keys"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", pub, hs)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Public key: %s\nAdd it to %s on machines verifying your snapshots\n", pub, filepath.Join(d, "trusted_keys"))
+	return nil
+}
+
+// verifySig checks each snapshot checksum and signature
+func verifySig(paths ...string) error {
+	if len(paths) == 0 {
+		paths = []string{spath}
+	}
+	trusted, err := readTrustedKeys()
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, path := range paths {
+		t, err := readTree(path)
+		switch {
+		case err != nil:
+			fmt.Fprintf(output, color.Red+"%s: %s\n"+color.Reset, path, err)
+			failed++
+			continue
+		case t.Footer == nil || t.Footer.Checksum == nil:
+			fmt.Fprintf(output, color.Red+"%s: no checksum, snapshot predates signatures\n"+color.Reset, path)
+			failed++
+			continue
+		}
+		k, err := t.Footer.Verify(trusted)
+		switch err {
+		case nil:
+			fmt.Fprintf(output, color.Green+"%s: signed by %s %s\n"+color.Reset, path, internal.FormatVerifyKey(k.Key), k.Name)
+		case internal.ErrUntrusted:
+			fmt.Fprintf(output, color.Yellow+"%s: intact, signed by untrusted %s\n"+color.Reset, path, internal.FormatVerifyKey(t.Footer.SignerKey))
+			failed++
+		case internal.ErrBadSignature:
+			fmt.Fprintf(output, color.Red+"%s: %s, snapshot or signature was tampered with\n"+color.Reset, path, err)
+			failed++
+		default:
+			fmt.Fprintf(output, color.Red+"%s: intact, %s\n"+color.Reset, path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d snapshots failed verification", failed)
+	}
+	return nil
+}
+
+// isEncrypted tells whether the snapshot at path is encrypted
+func isEncrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 8)
+	n, _ := io.ReadFull(f, head)
+	return internal.IsEncrypted(head[:n]), nil
+}
+
+// keygen writes a new identity to path, or prints it when path is empty
+func keygen(path string) error {
+	id, err := internal.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("# public key: %s\n%s\n", id.X25519Recipient(), id)
+	if path == "" {
+		fmt.Fprint(output, content)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Public key: %s\n", id.X25519Recipient())
+	return nil
+}
+
+// identities open encrypted snapshots, tried in order
+var identities []internal.Identity
+
+// setupIdentities registers the keys able to open encrypted snapshots
+func setupIdentities() error {
+	if p := os.Getenv("HSNAP_PASSPHRASE"); p != "" {
+		identities = append(identities, internal.Passphrase(p))
+	}
+	if identity != "" {
+		id, err := internal.ReadIdentityFile(identity)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, id)
+	}
+	return nil
+}
+
+// parseRecipients reads public keys given as is or as files (a key file from
+// keygen works too), and the passphrase when asked for.
+func parseRecipients(keys []string, passphrase bool) (rs []internal.Recipient, err error) {
+	if passphrase {
+		p := os.Getenv("HSNAP_PASSPHRASE")
+		if p == "" {
+			return nil, fmt.Errorf("set HSNAP_PASSPHRASE to encrypt with a passphrase")
+		}
+		rs = append(rs, internal.Passphrase(p))
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "hsnap1") {
+			b, err := os.ReadFile(k)
+			if err != nil {
+				return nil, err
+			}
+			k = ""
+			for _, line := range strings.Split(string(b), "\n") {
+				line = strings.TrimPrefix(strings.TrimSpace(line), "# public key: ")
+				if strings.HasPrefix(line, "hsnap1") {
+					k = line
+					break
+				}
+			}
+		}
+		r, err := internal.ParseX25519Recipient(k)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+// readInfo decodes only the Info header of a snapshot
+func readInfo(path string) (*internal.Info, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dr, _, err := internal.Decompress(f, identities...)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	i := new(internal.Info)
+	if err := gob.NewDecoder(dr).Decode(i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// convert recompresses a snapshot, in place when out is empty. The
+// uncompressed content is kept as is, and so is encryption: the output is
+// encrypted for the same recipients as the input.
+func convert(comp internal.Compression, in, out string) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	plain, env, err := internal.Decrypt(src, identities...)
+	if err != nil {
+		return err
+	}
+	dr, from, err := internal.Decompress(plain)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	dst := out
+	if out == "" {
+		dst = in + ".tmp"
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	ew := io.WriteCloser(f)
+	if env != nil {
+		ew, err = env.Encrypt(f)
+	}
+	var zw io.WriteCloser
+	if err == nil {
+		zw, err = internal.CompressSnapshot(ew, comp)
+	}
+	if err == nil {
+		_, err = io.Copy(zw, dr)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil && env != nil {
+		err = ew.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && out == "" {
+		err = os.Rename(dst, in)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	fmt.Fprintf(output, "Converted %s from %s to %s\n", in, from, comp)
+	return nil
+}
+
+// openIndex returns the index of the snapshot at path, or nil when it has
+// none or when the index is stale.
+func openIndex(path string) *internal.Index {
+	if _, err := os.Stat(internal.IndexPath(path)); err != nil {
+		return nil
+	}
+	i, err := readInfo(path)
+	if err != nil {
+		return nil
+	}
+	x, err := internal.OpenIndex(internal.IndexPath(path), i)
+	if err != nil {
+		log.Printf("Ignoring index: %s", err)
+		return nil
+	}
+	return x
+}
+
+// index writes the index file of each snapshot
+func index(paths ...string) error {
+	if len(paths) == 0 {
+		paths = []string{spath}
+	}
+	for _, path := range paths {
+		if encrypted, err := isEncrypted(path); err != nil || encrypted {
+			if err == nil {
+				err = fmt.Errorf("%s is encrypted, an index would expose its content", path)
+			}
+			return err
+		}
+		t, err := readTree(path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(internal.IndexPath(path))
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(f)
+		err = internal.WriteIndex(t, bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
 		}
+		fmt.Fprintf(output, "Indexed %s\n", path)
 	}
 	return nil
 }
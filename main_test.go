@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/dav-m85/hsnap/internal"
+	"github.com/matryer/is"
+)
+
+func TestFindArgs(t *testing.T) {
+	is := is.New(t)
+
+	var asJSON bool
+	var path string
+	cm := flag.NewFlagSet("find", flag.ContinueOnError)
+	cm.BoolVar(&asJSON, "json", false, "")
+	cm.StringVar(&path, "hsnap", "", "")
+
+	// Flags may follow the query, arguments of primaries are left alone
+	args := queryFlags(cm, []string{"snap.hsnap", "-name", "*.jpg", "-json", "-hsnap", "x.hsnap", "-name", "-json"})
+	is.Equal(args, []string{"snap.hsnap", "-json", "-hsnap", "x.hsnap", "-name", "*.jpg", "-name", "-json"})
+
+	query := parseArgs(cm, args, internal.IsQueryToken)
+	is.True(asJSON)
+	is.Equal(path, "x.hsnap")
+	is.Equal(cm.Args(), []string{"snap.hsnap"})
+	is.Equal(query, []string{"-name", "*.jpg", "-name", "-json"})
+
+	args = queryFlags(cm, []string{"-size", "+1M", "-hsnap=y.hsnap", "!", "-dup", "other"})
+	is.Equal(args, []string{"-hsnap=y.hsnap", "-size", "+1M", "!", "-dup", "other"})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dav-m85/hsnap/internal"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// parseRemote splits a remote directory given as [user@]host:path the way
+// scp does, or as ssh://[user@]host[:port]/path to give a port. IPv6 hosts
+// are enclosed in brackets. User defaults to the local one, port to 22 and
+// path to the remote home.
+func parseRemote(remote string) (usr, host, port, path string, err error) {
+	bad := fmt.Errorf("remote %s is not [user@]host:path nor ssh://[user@]host[:port]/path", remote)
+	if strings.HasPrefix(remote, "ssh://") {
+		u, err := url.Parse(remote)
+		if err != nil || u.Hostname() == "" || u.RawQuery != "" || u.Fragment != "" {
+			return "", "", "", "", bad
+		}
+		host, port, path = u.Hostname(), u.Port(), u.Path
+		if u.User != nil {
+			usr = u.User.Username()
+		}
+	} else {
+		rest := remote
+		end := strings.IndexAny(rest, ":[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if i := strings.LastIndex(rest[:end], "@"); i >= 0 {
+			usr, rest = rest[:i], rest[i+1:]
+		}
+		if strings.HasPrefix(rest, "[") {
+			i := strings.Index(rest, "]:")
+			if i < 0 {
+				return "", "", "", "", bad
+			}
+			host, path = rest[1:i], rest[i+2:]
+		} else {
+			i := strings.IndexRune(rest, ':')
+			if i < 0 {
+				return "", "", "", "", bad
+			}
+			host, path = rest[:i], rest[i+1:]
+		}
+		if host == "" {
+			return "", "", "", "", bad
+		}
+	}
+
+	if usr == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", "", "", err
+		}
+		usr = u.Username
+	}
+	if port == "" {
+		port = "22"
+	}
+	if path == "" {
+		path = "."
+	}
+	return usr, host, port, path, nil
+}
+
+// sshConfig authenticates with the ssh agent and the usual keys of ~/.ssh,
+// checking the host at addr against ~/.ssh/known_hosts
+func sshConfig(usr, addr string) (*ssh.ClientConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("host keys are checked against known_hosts: %w", err)
+	}
+
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if ss, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, ss...)
+			}
+		}
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		b, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Keys protected by a passphrase are expected in the agent
+		if s, err := ssh.ParsePrivateKey(b); err == nil {
+			signers = append(signers, s)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no ssh key found, in the ssh agent or ~/.ssh")
+	}
+
+	return &ssh.ClientConfig{
+		User:              usr,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeys, addr),
+	}, nil
+}
+
+// preferredHostKeys orders host key algorithms, strongest first
+var preferredHostKeys = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// hostKeyAlgorithms lists the algorithms of the keys known_hosts has for
+// addr, for the server to present one of them rather than whichever it
+// prefers, which may be unknown here. None means any.
+func hostKeyAlgorithms(hostKeys ssh.HostKeyCallback, addr string) (algos []string) {
+	// Known keys come with the error of a key matching none of them
+	var keyErr *knownhosts.KeyError
+	err := hostKeys(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{})
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, k := range keyErr.Want {
+		names := []string{k.Key.Type()}
+		if names[0] == ssh.KeyAlgoRSA {
+			names = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				algos = append(algos, name)
+			}
+		}
+	}
+	// known_hosts lines come in no particular order
+	rank := func(algo string) int {
+		for i, a := range preferredHostKeys {
+			if a == algo {
+				return i
+			}
+		}
+		return len(preferredHostKeys)
+	}
+	sort.SliceStable(algos, func(i, j int) bool {
+		return rank(algos[i]) < rank(algos[j])
+	})
+	return
+}
+
+// probeKey is a public key no host has
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "probe" }
+func (probeKey) Marshal() []byte                     { return []byte("probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key") }
+
+// createRemote snapshots a directory of a remote host, see parseRemote, over
+// SFTP. Nothing but an SSH server is needed
+// there, files are hashed here.
+func createRemote(remote string, spy io.Writer, opt internal.SnapshotOptions) error {
+	usr, host, port, path, err := parseRemote(remote)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(host, port)
+	config, err := sshConfig(usr, addr)
+	if err != nil {
+		return err
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Snapshots record absolute paths
+	if path, err = c.RealPath(path); err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+	if info, err := c.Stat(path); err != nil {
+		return fmt.Errorf("%s:%s: %w", host, path, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s:%s is not a directory", host, path)
+	}
+
+	internal.FS = internal.NewSFTP(c)
+	defer func() { internal.FS = internal.OS{} }()
+	opt.Hostname = host
+	return snapshot(path, spy, opt)
+}
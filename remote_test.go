@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseRemote(t *testing.T) {
+	is := is.New(t)
+
+	u, err := user.Current()
+	is.NoErr(err)
+	me := u.Username
+
+	for _, c := range []struct {
+		remote                string
+		usr, host, port, path string
+	}{
+		{"nas:/volume1", me, "nas", "22", "/volume1"},
+		{"admin@nas:/volume1", "admin", "nas", "22", "/volume1"},
+		{"nas:", me, "nas", "22", "."},
+		{"nas:photos", me, "nas", "22", "photos"},
+		{"nas:2022:notes", me, "nas", "22", "2022:notes"}, // no port in scp form
+		{"a@b@nas:/x", "a@b", "nas", "22", "/x"},
+		{"admin@[fd00::2]:/volume1", "admin", "fd00::2", "22", "/volume1"},
+		{"ssh://nas/volume1", me, "nas", "22", "/volume1"},
+		{"ssh://admin@nas:2222/volume1", "admin", "nas", "2222", "/volume1"},
+		{"ssh://admin@[fd00::2]:2222/volume1", "admin", "fd00::2", "2222", "/volume1"},
+		{"ssh://[::1]", me, "::1", "22", "."},
+	} {
+		usr, host, port, path, err := parseRemote(c.remote)
+		is.NoErr(err)
+		is.Equal([]string{usr, host, port, path}, []string{c.usr, c.host, c.port, c.path}) // c.remote
+	}
+
+	for _, bad := range []string{
+		"nas", ":/volume1", "admin@:/x", "[fd00::2]/x", "[fd00::2]", "ssh://",
+		"ssh://admin@/x", "ssh://nas:port/x", "ssh://[fd00::2/x", "ssh://nas/x?y",
+	} {
+		_, _, _, _, err := parseRemote(bad)
+		is.True(err != nil) // bad
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	is := is.New(t)
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	is.NoErr(err)
+	ed, err := ssh.NewPublicKey(edPub)
+	is.NoErr(err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	is.NoErr(err)
+	rs, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	is.NoErr(err)
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	is.NoErr(os.WriteFile(path, []byte(strings.Join([]string{
+		knownhosts.Line([]string{"nas"}, rs),
+		knownhosts.Line([]string{"nas"}, ed),
+		knownhosts.Line([]string{"[nas]:2222"}, ed),
+	}, "\n")+"\n"), 0600))
+	hostKeys, err := knownhosts.New(path)
+	is.NoErr(err)
+
+	is.Equal(hostKeyAlgorithms(hostKeys, "nas:22"), []string{
+		ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+	})
+	is.Equal(hostKeyAlgorithms(hostKeys, "nas:2222"), []string{ssh.KeyAlgoED25519})
+	is.Equal(len(hostKeyAlgorithms(hostKeys, "other:22")), 0)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dav-m85/hsnap/internal"
+	"golang.org/x/term"
+)
+
+// reviewer is the state of the interactive review of trim and dup, see
+// review. Rows are the visible groups, followed by their copies when
+// expanded.
+type reviewer struct {
+	r        *internal.Review
+	expanded map[*internal.ReviewGroup]bool
+	rows     []reviewRow
+	cursor   int
+	top      int
+
+	filter    string
+	filtering bool
+	confirm   bool
+	msg       string
+}
+
+type reviewRow struct {
+	g *internal.ReviewGroup
+	n *internal.Node // nil for the group row
+}
+
+func newReviewer(r *internal.Review) *reviewer {
+	v := &reviewer{r: r, expanded: make(map[*internal.ReviewGroup]bool)}
+	v.layout()
+	return v
+}
+
+// layout rebuilds rows after groups got filtered, expanded or collapsed,
+// keeping the cursor on the same group
+func (v *reviewer) layout() {
+	var at *internal.ReviewGroup
+	if v.cursor < len(v.rows) {
+		at = v.rows[v.cursor].g
+	}
+	v.rows = v.rows[:0]
+	v.cursor = 0
+	for _, g := range v.r.Groups {
+		if v.filter != "" && !g.Match(v.filter) {
+			continue
+		}
+		if g == at {
+			v.cursor = len(v.rows)
+		}
+		v.rows = append(v.rows, reviewRow{g: g})
+		if !v.expanded[g] {
+			continue
+		}
+		for _, ns := range []internal.Nodes{g.Local, g.Others} {
+			for _, n := range ns {
+				v.rows = append(v.rows, reviewRow{g, n})
+			}
+		}
+	}
+}
+
+// key handles a key press, as named by readKey. It tells whether the review
+// is over, and whether the plan has to be applied.
+func (v *reviewer) key(k string) (done, apply bool) {
+	v.msg = ""
+	switch {
+	case v.confirm:
+		v.confirm = false
+		return k == "y", k == "y"
+	case v.filtering:
+		switch k {
+		case "enter", "esc":
+			v.filtering = false
+		case "backspace":
+			if v.filter != "" {
+				v.filter = v.filter[:len(v.filter)-1]
+			}
+		case "ctrl-c":
+			return true, false
+		default:
+			if len(k) == 1 || k == "space" {
+				v.filter += strings.Replace(k, "space", " ", 1)
+			}
+		}
+		v.layout()
+		return
+	}
+
+	switch k {
+	case "q", "ctrl-c":
+		return true, false
+	case "up", "k":
+		v.move(-1)
+	case "down", "j":
+		v.move(1)
+	case "pgup":
+		v.move(-10)
+	case "pgdown":
+		v.move(10)
+	case "home", "g":
+		v.move(-len(v.rows))
+	case "end", "G":
+		v.move(len(v.rows))
+	case "enter", "right", "l", "left", "h":
+		if len(v.rows) == 0 {
+			break
+		}
+		g := v.rows[v.cursor].g
+		v.expanded[g] = (k == "enter" && !v.expanded[g]) || k == "right" || k == "l"
+		v.layout()
+	case "space":
+		v.mark()
+	case "/":
+		v.filtering = true
+	case "d":
+		if _, _, freed := v.r.Plan(); freed.Files == 0 {
+			v.msg = "Nothing marked, use space to mark copies"
+		} else {
+			v.confirm = true
+		}
+	}
+	return
+}
+
+func (v *reviewer) move(d int) {
+	v.cursor += d
+	if v.cursor >= len(v.rows) {
+		v.cursor = len(v.rows) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+}
+
+// mark toggles the copy under the cursor, or the whole group
+func (v *reviewer) mark() {
+	if len(v.rows) == 0 {
+		return
+	}
+	row := v.rows[v.cursor]
+	if row.n == nil {
+		v.r.MarkGroup(row.g, !v.groupMarked(row.g))
+		return
+	}
+	if err := v.r.Mark(row.g, row.n, !v.r.Marked(row.n)); err != nil {
+		v.msg = err.Error()
+	}
+}
+
+// groupMarked tells whether any copy of g is marked
+func (v *reviewer) groupMarked(g *internal.ReviewGroup) bool {
+	for _, n := range g.Local {
+		if v.r.Marked(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// view renders the screen as lines, at most height of them
+func (v *reviewer) view(width, height int) []string {
+	_, _, freed := v.r.Plan()
+	lines := []string{
+		fmt.Sprintf("%d groups, %d files marked freeing %s", len(v.r.Groups), freed.Files, internal.ByteSize(freed.Bytes)),
+	}
+
+	body := height - 2
+	if body < 1 {
+		body = 1
+	}
+	if v.cursor < v.top {
+		v.top = v.cursor
+	}
+	if v.cursor >= v.top+body {
+		v.top = v.cursor - body + 1
+	}
+	for i := v.top; i < len(v.rows) && i < v.top+body; i++ {
+		lines = append(lines, v.line(v.rows[i], i == v.cursor, width))
+	}
+	for len(lines) < body+1 {
+		lines = append(lines, "")
+	}
+
+	var status string
+	switch {
+	case v.confirm:
+		status = fmt.Sprintf("Delete %d files, %s? y/n", freed.Files, internal.ByteSize(freed.Bytes))
+	case v.filtering:
+		status = "/" + v.filter
+	case v.msg != "":
+		status = v.msg
+	default:
+		status = "↑↓ move, enter expand, space mark, / filter, d delete marked, q quit"
+		if v.filter != "" {
+			status = "[" + v.filter + "] " + status
+		}
+	}
+	return append(lines, truncate(status, width))
+}
+
+func (v *reviewer) line(row reviewRow, selected bool, width int) string {
+	g := row.g
+	var s, c string
+	switch {
+	case row.n == nil:
+		arrow, what := "▸", "files"
+		if v.expanded[g] {
+			arrow = "▾"
+		}
+		if g.Dir {
+			what = fmt.Sprintf("directories of %d files", g.Stats.Files)
+		}
+		s = fmt.Sprintf("%s %d %s (wasting %s) %s", arrow, len(g.Local)+len(g.Others), what, internal.ByteSize(g.Waste()), g.Local[0].Name)
+		if v.groupMarked(g) {
+			c = color.Yellow
+		}
+	case !isLocal(g, row.n):
+		s, c = "        +"+reviewLabel(g, row.n), color.Green
+	case v.r.Marked(row.n):
+		s, c = "    [x] -"+reviewLabel(g, row.n), color.Yellow
+	default:
+		s, c = "    [ ] -"+reviewLabel(g, row.n), color.Red
+	}
+	s = truncate(s, width)
+	if selected {
+		c += "\033[7m"
+	}
+	if c != "" {
+		s = c + s + color.Reset
+	}
+	return s
+}
+
+func isLocal(g *internal.ReviewGroup, n *internal.Node) bool {
+	for _, x := range g.Local {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+func reviewLabel(g *internal.ReviewGroup, n *internal.Node) string {
+	if g.Dir {
+		return nodeLabel(n) + "/"
+	}
+	return nodeLabel(n)
+}
+
+// truncate s to width runes
+func truncate(s string, width int) string {
+	if r := []rune(s); width > 0 && len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// readKey reads a key press from a raw terminal, and names it
+func readKey(f *os.File) (string, error) {
+	var buf [8]byte
+	n, err := f.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	switch s := string(buf[:n]); s {
+	case "\x1b[A", "\x1bOA":
+		return "up", nil
+	case "\x1b[B", "\x1bOB":
+		return "down", nil
+	case "\x1b[C", "\x1bOC":
+		return "right", nil
+	case "\x1b[D", "\x1bOD":
+		return "left", nil
+	case "\x1b[5~":
+		return "pgup", nil
+	case "\x1b[6~":
+		return "pgdown", nil
+	case "\x1b[H", "\x1b[1~":
+		return "home", nil
+	case "\x1b[F", "\x1b[4~":
+		return "end", nil
+	case "\x1b":
+		return "esc", nil
+	case "\r", "\n":
+		return "enter", nil
+	case " ":
+		return "space", nil
+	case "\x7f", "\b":
+		return "backspace", nil
+	case "\x03":
+		return "ctrl-c", nil
+	default:
+		return s, nil
+	}
+}
+
+// review lets the user pick copies to delete in a full screen view, then
+// deletes them. Nothing is deleted unless confirmed.
+func review(r *internal.Review) error {
+	if len(r.Groups) == 0 {
+		fmt.Fprintln(output, "Nothing to review")
+		return nil
+	}
+	in, out := os.Stdin, os.Stdout
+	if !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return errors.New("interactive review needs a terminal")
+	}
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return err
+	}
+	// Alternate screen, hidden cursor
+	fmt.Fprint(out, "\033[?1049h\033[?25l")
+
+	v := newReviewer(r)
+	var apply bool
+	for {
+		w, h, err := term.GetSize(int(out.Fd()))
+		if err != nil || h == 0 {
+			w, h = 80, 24
+		}
+		fmt.Fprint(out, "\033[H\033[2J"+strings.Join(v.view(w, h), "\r\n"))
+
+		k, err := readKey(in)
+		if err != nil {
+			break
+		}
+		var done bool
+		if done, apply = v.key(k); done {
+			break
+		}
+	}
+
+	fmt.Fprint(out, "\033[?25h\033[?1049l")
+	if err := term.Restore(int(in.Fd()), state); err != nil {
+		return err
+	}
+	if !apply {
+		fmt.Fprintln(output, "Nothing deleted")
+		return nil
+	}
+	return applyReview(r)
+}
+
+// applyReview deletes the marked copies, the way trim -delete does
+func applyReview(r *internal.Review) error {
+	dirs, files, _ := r.Plan()
+	var count, errc int
+	var freed int64
+	for _, d := range dirs {
+		c, e, f := removeDir(d)
+		count, errc, freed = count+c, errc+e, freed+f
+	}
+	for _, n := range files {
+		p := n.Tree().AbsPath(n)
+		if err := os.Remove(p); err != nil {
+			fmt.Fprintf(output, "Cannot remove %s: %s\n", p, err)
+			errc++
+		} else {
+			fmt.Fprintf(output, "Removed %s\n", p)
+			count++
+			freed += n.Size
+		}
+	}
+	fmt.Fprintf(output, "Removed %d files totalling %s, %d errors\n", count, internal.ByteSize(freed), errc)
+	if errc != 0 {
+		return errors.New("Delete got some errors while processing")
+	}
+	return nil
+}